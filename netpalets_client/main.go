@@ -3,7 +3,9 @@ package main
 import (
 	//"fmt"
 	"bytes"
+	"crypto/ecdh"
 	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"github.com/beati/netpalets/gamestate"
 	"github.com/beati/netpalets/rendering"
@@ -15,9 +17,14 @@ import (
 )
 
 func main() {
-	runtime.LockOSThread()
-	player := flag.Int("player", 0, "player number, 1 or 2")
+	server := flag.String("server", "195.154.73.145:3000",
+		"server address, IPv6 addresses in brackets")
+	serverKeyHex := flag.String("serverkey", "",
+		"hex encoded X25519 public key of the server, enables secure mode")
+	compress := flag.Bool("compress", false, "ask for compressed packets")
 	flag.Parse()
+
+	runtime.LockOSThread()
 	//runtime.GOMAXPROCS(4)
 	var err error
 
@@ -34,39 +41,60 @@ func main() {
 
 	//sdl.ShowCursor(false)
 
+	channels := []rtgp.Channel{
+		{Name: "state", Delivery: rtgp.Sequenced},
+		{Name: "input", Delivery: rtgp.ReliableOrdered},
+	}
 	msgTypes := make([]rtgp.MsgType, 2)
-	msgTypes[0] = rtgp.MsgType{128, false}
-	msgTypes[1] = rtgp.MsgType{8, true}
-	var c *rtgp.Conn
-	if *player == 1 {
-		c, err = rtgp.NewConn(":3001", msgTypes, 30)
-	} else if *player == 2 {
-		c, err = rtgp.NewConn(":3002", msgTypes, 30)
-	} else {
-		log.Fatal(nil)
+	msgTypes[0] = rtgp.MsgType{Size: 512, Variable: true, Channel: "state"}
+	msgTypes[1] = rtgp.MsgType{Size: 8, Channel: "input"}
+	e, err := rtgp.NewUDPEndpoint(":0")
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer e.Close()
+	c, err := e.NewConn(channels, msgTypes, 30)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = c.SetRemoteAddrAndSessionID("195.154.73.145:3000", 0)
+	err = c.SetCompression(*compress)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *serverKeyHex == "" {
+		err = c.Connect(*server)
+	} else {
+		var b []byte
+		b, err = hex.DecodeString(*serverKeyHex)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var serverKey *ecdh.PublicKey
+		serverKey, err = ecdh.X25519().NewPublicKey(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = c.ConnectSecure(*server, serverKey)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
 
 	t := time.Now()
 
-	gc := make(chan []byte)
-	go func() {
-		for {
-			_, g := c.RecvMsg()
-			gc <- g
-		}
-	}()
-
 	g := make([]byte, 128)
 	for sdl.Running {
+		for {
+			_, d, ok := c.TryRecvMsg()
+			if !ok {
+				break
+			}
+			g = d
+		}
 		select {
-		case g = <-gc:
+		case <-c.Done():
+			log.Fatal(c.Err())
 		default:
 		}
 		rendering.RenderFromNet(g)
@@ -79,7 +107,10 @@ func main() {
 			y := int32(sdl.Mouse.Y)
 			binary.Write(&in, binary.LittleEndian, x)
 			binary.Write(&in, binary.LittleEndian, y)
-			c.SendReliableMsg(1, in.Bytes(), false)
+			err = c.SendReliableMsg(1, in.Bytes(), true)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 
 		dt := time.Since(t)
@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/hex"
+	"flag"
 	//"fmt"
 	"encoding/binary"
 	"github.com/beati/netpalets/gamestate"
 	"github.com/beati/netpalets/rtgp"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -15,7 +20,21 @@ type input struct {
 	Y int32
 }
 
-func play(dataLock chan []byte, i1 chan input, i2 chan input) {
+// state holds the last serialized game state, which is sent to the
+// players.
+type state struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (s *state) Snapshot(dst []byte) []byte {
+	s.mutex.Lock()
+	dst = append(dst, s.data...)
+	s.mutex.Unlock()
+	return dst
+}
+
+func play(s *state, i1 chan input, i2 chan input, done chan struct{}) {
 	g := gamestate.NewGameState()
 	ticker := time.NewTicker(15 * time.Millisecond)
 	t := time.Now()
@@ -26,59 +45,130 @@ func play(dataLock chan []byte, i1 chan input, i2 chan input) {
 			g.Launch(0, int(input1.X), int(input1.Y))
 		case input2 := <-i2:
 			g.Launch(7, int(input2.X), int(input2.Y))
+		case <-done:
+			ticker.Stop()
+			return
 		}
 
 		dt := time.Since(t)
 		t = time.Now()
 		g.Step(dt)
-		<-dataLock
 		var b bytes.Buffer
 		g.Serialize(&b)
-		dataLock <- b.Bytes()
+		s.mutex.Lock()
+		s.data = b.Bytes()
+		s.mutex.Unlock()
 	}
 }
 
-func recvInputs(c *rtgp.Conn, i chan input) {
-	for {
-		_, in := c.RecvMsg()
+func handleInputs(c *rtgp.Conn, i chan input, done chan struct{}) {
+	err := c.Handle(1, func(in []byte) {
 		r := bytes.NewReader(in)
 		var input input
 		binary.Read(r, binary.LittleEndian, &input)
-		i <- input
+		select {
+		case i <- input:
+		case <-done:
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
-func main() {
-	msgTypes := make([]rtgp.MsgType, 2)
-	msgTypes[0] = rtgp.MsgType{128, false}
-	msgTypes[1] = rtgp.MsgType{8, true}
-	c1, err := rtgp.NewConn(":3000", msgTypes, 100)
+func logStats(player int, c *rtgp.Conn) {
+	s := c.Stats()
+	log.Printf("player %d: rtt %v, jitter %v, loss %.1f%% sent %.1f%% "+
+		"received, %d/%d bytes sent/received, %d retransmissions, "+
+		"tick rate %d",
+		player, s.RTT, s.Jitter, 100*s.SentLoss, 100*s.RecvLoss,
+		s.BytesSent, s.BytesRecved, s.Retransmissions, s.TickRate)
+}
+
+func match(c1, c2 *rtgp.Conn) {
+	done := make(chan struct{})
+	i1 := make(chan input)
+	handleInputs(c1, i1, done)
+	i2 := make(chan input)
+	handleInputs(c2, i2, done)
+
+	c1.SetAdaptiveTickRate(20, 100)
+	c2.SetAdaptiveTickRate(20, 100)
+
+	s := new(state)
+	go play(s, i1, i2, done)
+	err := c1.SendPeriodicMsg(0, s)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = c1.SetRemoteAddrAndSessionID("85.171.104.166:3001", 1)
+	err = c2.SendPeriodicMsg(0, s)
 	if err != nil {
 		log.Fatal(err)
 	}
-	i1 := make(chan input)
-	go recvInputs(c1, i1)
-	c2, err := rtgp.NewConn(":3000", msgTypes, 100)
+
+	select {
+	case <-c1.Done():
+		log.Printf("player 1 left: %v", c1.Err())
+	case <-c2.Done():
+		log.Printf("player 2 left: %v", c2.Err())
+	}
+	close(done)
+	logStats(1, c1)
+	logStats(2, c2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c1.CloseGracefully(ctx)
+	c2.CloseGracefully(ctx)
+}
+
+func main() {
+	addr := flag.String("addr", ":3000",
+		"address to listen on, on IPv4 and IPv6 if it has no IP")
+	keyHex := flag.String("key", "",
+		"hex encoded X25519 private key, enables secure mode")
+	flag.Parse()
+
+	channels := []rtgp.Channel{
+		{Name: "state", Delivery: rtgp.Sequenced},
+		{Name: "input", Delivery: rtgp.ReliableOrdered},
+	}
+	msgTypes := make([]rtgp.MsgType, 2)
+	msgTypes[0] = rtgp.MsgType{Size: 512, Variable: true, Channel: "state"}
+	msgTypes[1] = rtgp.MsgType{Size: 8, Channel: "input"}
+	e, err := rtgp.NewUDPEndpoint(*addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = c2.SetRemoteAddrAndSessionID("85.171.104.166:3002", 2)
+	var l *rtgp.Listener
+	if *keyHex == "" {
+		l, err = e.Listen(channels, msgTypes, 100)
+	} else {
+		var b []byte
+		b, err = hex.DecodeString(*keyHex)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var key *ecdh.PrivateKey
+		key, err = ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err = e.ListenSecure(channels, msgTypes, 100, key)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	i2 := make(chan input)
-	go recvInputs(c2, i2)
-
-	dataLock := make(chan []byte, 1)
-	dataLock <- make([]byte, msgTypes[0].Size)
-	go play(dataLock, i1, i2)
-	c1.SendPeriodicMsg(0, dataLock)
-	c2.SendPeriodicMsg(0, dataLock)
+	l.SetCompression(true)
 
-	l := make(chan bool)
-	<-l
+	for {
+		c1, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		c2, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go match(c1, c2)
+	}
 }
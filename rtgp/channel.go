@@ -0,0 +1,123 @@
+package rtgp
+
+import (
+	"fmt"
+)
+
+// Delivery is what is guaranteed for the messages of a channel.
+type Delivery int
+
+const (
+	// Unreliable messages can be lost.
+	Unreliable Delivery = iota
+	// ReliableUnordered messages are sent until they are acked, and
+	// delivered as soon as they are received.
+	ReliableUnordered
+	// ReliableOrdered messages are sent until they are acked, and
+	// delivered in the order they were sent on their channel.
+	ReliableOrdered
+	// Sequenced messages can be lost, and are dropped if a message of
+	// their type sent after them was delivered first, so that a periodic
+	// message late is not taken for the current one.
+	Sequenced
+)
+
+// A Channel is a stream of messages of a connection. Each channel has its
+// own message ids, so that a message waited for on a channel does not hold
+// back the messages of the others. Message types name the channel they are
+// sent on.
+type Channel struct {
+	Name     string
+	Delivery Delivery
+}
+
+// Messages of a channel are given ids if they are reliable or sequenced,
+// and unreliable messages if they are fragmented.
+type channel struct {
+	delivery     Delivery
+	nextMsgID    uint32
+	reliableMsgs map[uint32]*reliableMsg
+	rMsgIDs      map[uint32]struct{}
+	nextRMsgID   uint32
+	orderedMsgs  map[uint32]msg
+	rFragmented  map[uint32]*fragmentedMsg
+	rFragNewest  uint32
+	lastSeqIDs   map[uint16]uint32
+}
+
+// newChannels returns the state of channels, and the channel of each
+// message type.
+func newChannels(channels []Channel, msgTypes []MsgType) ([]*channel,
+	[]*channel, error) {
+	byName := make(map[string]*channel)
+	states := make([]*channel, len(channels))
+	for i, ch := range channels {
+		if _, found := byName[ch.Name]; found {
+			return nil, nil, fmt.Errorf("duplicate channel %q", ch.Name)
+		}
+		if ch.Delivery < Unreliable || ch.Delivery > Sequenced {
+			return nil, nil, fmt.Errorf("invalid delivery of channel %q",
+				ch.Name)
+		}
+		states[i] = &channel{
+			delivery:     ch.Delivery,
+			reliableMsgs: make(map[uint32]*reliableMsg),
+			rMsgIDs:      make(map[uint32]struct{}),
+			orderedMsgs:  make(map[uint32]msg),
+			rFragmented:  make(map[uint32]*fragmentedMsg),
+			lastSeqIDs:   make(map[uint16]uint32),
+		}
+		byName[ch.Name] = states[i]
+	}
+
+	if len(msgTypes) > periodicFlag {
+		return nil, nil, fmt.Errorf("too many message types")
+	}
+	typeChannels := make([]*channel, len(msgTypes))
+	for i, t := range msgTypes {
+		if t.Size < 0 || t.Size > maxMsgSize {
+			return nil, nil, fmt.Errorf("invalid size %d of message type %d",
+				t.Size, i)
+		}
+		ch, found := byName[t.Channel]
+		if !found {
+			return nil, nil, fmt.Errorf("unknown channel %q of message "+
+				"type %d", t.Channel, i)
+		}
+		typeChannels[i] = ch
+	}
+	return states, typeChannels, nil
+}
+
+func (ch *channel) reliable() bool {
+	return ch.delivery == ReliableUnordered || ch.delivery == ReliableOrdered
+}
+
+// seqID returns the id of a message sent now on the channel of msgType if
+// it is sequenced, 0 otherwise.
+func (c *Conn) seqID(msgType uint16) uint32 {
+	ch := c.typeChannels[msgType]
+	if ch.delivery != Sequenced {
+		return 0
+	}
+	id := ch.nextMsgID
+	ch.nextMsgID++
+	return id
+}
+
+// isNewSeqID reports whether a sequenced message was sent after the last
+// one of its type delivered. Ids of a channel are increasing, whatever the
+// type of the messages.
+func (ch *channel) isNewSeqID(msgType uint16, id uint32) bool {
+	last, found := ch.lastSeqIDs[msgType]
+	d := id - last
+	return !found || d != 0 && d < 1<<31
+}
+
+func (c *Conn) pendingReliable() int {
+	n := 0
+	for _, ch := range c.channels {
+		n += len(ch.reliableMsgs)
+	}
+	return n
+}
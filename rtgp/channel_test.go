@@ -0,0 +1,108 @@
+package rtgp
+
+import (
+	"testing"
+)
+
+func TestNewChannels(t *testing.T) {
+	channels := []Channel{{"", Unreliable}, {"ordered", ReliableOrdered}}
+	tests := []struct {
+		name     string
+		channels []Channel
+		msgTypes []MsgType
+		ok       bool
+	}{
+		{"valid", channels, []MsgType{{Size: 4}, {Size: 0, Variable: true,
+			Channel: "ordered"}}, true},
+		{"largest size", channels, []MsgType{{Size: maxMsgSize,
+			Variable: true}}, true},
+		{"negative size", channels, []MsgType{{Size: -1}}, false},
+		{"negative variable size", channels, []MsgType{{Size: -1,
+			Variable: true}}, false},
+		{"size too large", channels, []MsgType{{Size: maxMsgSize + 1,
+			Variable: true}}, false},
+		{"unknown channel", channels, []MsgType{{Size: 4,
+			Channel: "lobby"}}, false},
+		{"duplicate channel", []Channel{{"", Unreliable},
+			{"", Sequenced}}, []MsgType{{Size: 4}}, false},
+		{"invalid delivery", []Channel{{"", Sequenced + 1}},
+			[]MsgType{{Size: 4}}, false},
+	}
+	for _, tt := range tests {
+		_, _, err := newChannels(tt.channels, tt.msgTypes)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestListenNegativeSize(t *testing.T) {
+	network := NewMemNetwork(LinkConfig{}, 1)
+	pc, err := network.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEndpoint(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	msgTypes := []MsgType{{Size: -1, Variable: true}}
+	_, err = e.Listen([]Channel{{"", Unreliable}}, msgTypes, 100)
+	if err == nil {
+		t.Error("Listen accepted a negative message size")
+	}
+	_, err = e.NewConn([]Channel{{"", Unreliable}}, msgTypes, 100)
+	if err == nil {
+		t.Error("NewConn accepted a negative message size")
+	}
+}
+
+func TestSequencedStaleDropped(t *testing.T) {
+	channels := []Channel{{"", Sequenced}}
+	msgTypes := []MsgType{{Size: 1}, {Size: 1}}
+	c, err := newConn(nil, channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		msgType uint16
+		id      uint32
+		want    bool
+	}{
+		{0, 5, true},
+		{1, 3, true}, // older than the last of type 0
+		{0, 4, false},
+		{0, 5, false},
+		{1, 6, true},
+		{0, 7, true},
+		{1, 4, false},
+		{0, 0xfffffff0, false}, // behind 7 once wrapped
+		{0, 7 + 1<<31, false},  // half the ids away
+		{0, 6 + 1<<31, true},   // just less than half the ids away
+		{0, 0xfffffffe, true},  // before the wrap
+		{0, 2, true},           // after the wrap
+		{0, 0xffffffff, false}, // before the wrap, now stale
+		{1, 5 + 1<<31, true},   // stale for type 0, not for type 1
+	}
+	stale := 0
+	for i, s := range steps {
+		recved := len(c.recvedMsgs)
+		c.recvMsg(msg{s.msgType, []byte{byte(i)}}, s.id)
+		delivered := len(c.recvedMsgs) > recved
+		if delivered != s.want {
+			t.Fatalf("step %d: type %d id %#x delivered %v, want %v", i,
+				s.msgType, s.id, delivered, s.want)
+		}
+		if !s.want {
+			stale++
+		}
+	}
+	if n := c.Stats().StaleDropped; n != uint64(stale) {
+		t.Fatalf("%d stale messages dropped, want %d", n, stale)
+	}
+}
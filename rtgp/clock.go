@@ -0,0 +1,175 @@
+package rtgp
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// A SimClock is a virtual clock for the endpoints of a MemNetwork made with
+// NewSimNetwork. Their packets are delivered and their connections send on
+// their ticks as events of the clock, run one at a time in order of time
+// from the goroutine advancing it, so that with the seed of the network a
+// run is reproduced exactly.
+//
+// Time passes when Advance is called, and while Connect, Accept, RecvMsg
+// and CloseGracefully wait. The runs are only reproducible if the
+// connections are used from a single goroutine.
+type SimClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	events simEvents
+	nextID uint64
+}
+
+type simEvent struct {
+	at time.Time
+	id uint64
+	f  func()
+}
+
+// simEvents is a heap of events, events at the same time being run in the
+// order they were scheduled.
+type simEvents []simEvent
+
+func (h simEvents) Len() int {
+	return len(h)
+}
+
+func (h simEvents) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].id < h[j].id
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h simEvents) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *simEvents) Push(x any) {
+	*h = append(*h, x.(simEvent))
+}
+
+func (h *simEvents) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// NewSimClock returns a clock starting at the same time on every run.
+func NewSimClock() *SimClock {
+	c := new(SimClock)
+	c.now = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return c
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mutex.Lock()
+	now := c.now
+	c.mutex.Unlock()
+	return now
+}
+
+// Advance runs the events of the next d.
+func (c *SimClock) Advance(d time.Duration) {
+	end := c.Now().Add(d)
+	for c.step(end) {
+	}
+	c.mutex.Lock()
+	c.now = end
+	c.mutex.Unlock()
+}
+
+func (c *SimClock) schedule(d time.Duration, f func()) {
+	c.mutex.Lock()
+	heap.Push(&c.events, simEvent{c.now.Add(d), c.nextID, f})
+	c.nextID++
+	c.mutex.Unlock()
+}
+
+// step runs the next event if it is due by end, or whenever it is if end
+// is zero.
+func (c *SimClock) step(end time.Time) bool {
+	c.mutex.Lock()
+	if len(c.events) == 0 || !end.IsZero() && c.events[0].at.After(end) {
+		c.mutex.Unlock()
+		return false
+	}
+	e := heap.Pop(&c.events).(simEvent)
+	c.now = e.at
+	c.mutex.Unlock()
+
+	e.f()
+	return true
+}
+
+// runUntil runs events until done returns true, for at most limit if it is
+// not 0.
+func (c *SimClock) runUntil(done func() bool, limit time.Duration) {
+	var end time.Time
+	if limit > 0 {
+		end = c.Now().Add(limit)
+	}
+	for !done() {
+		if !c.step(end) {
+			if limit > 0 {
+				c.mutex.Lock()
+				c.now = end
+				c.mutex.Unlock()
+			}
+			return
+		}
+	}
+}
+
+// now is the time of the connection, the one of its SimClock if it has one.
+func (c *Conn) now() time.Time {
+	if c.clock != nil {
+		return c.clock.Now()
+	}
+	return time.Now()
+}
+
+// simConnect sends the connection requests of Connect, running the clock
+// between them.
+func (c *Conn) simConnect(ephPub []byte) error {
+	deadline := c.now().Add(connectTimeout)
+	for {
+		c.sendConnect(ephPub)
+		c.clock.runUntil(func() bool {
+			return isClosed(c.established) || isClosed(c.done)
+		}, connectRetryPeriod)
+
+		switch {
+		case isClosed(c.established):
+			return nil
+		case isClosed(c.done):
+			return c.Err()
+		case !c.now().Before(deadline):
+			c.mutex.Lock()
+			c.terminate(ErrTimeout)
+			c.mutex.Unlock()
+			return c.Err()
+		}
+	}
+}
+
+func (c *Conn) simTick() {
+	if _, sending := c.sendTick(nil); !sending {
+		return
+	}
+	c.mutex.Lock()
+	tickrate := c.tickrate
+	c.mutex.Unlock()
+	c.clock.schedule(tickPeriod(tickrate), c.simTick)
+}
+
+func (c *Conn) simFlush() {
+	select {
+	case <-c.flush:
+	default:
+	}
+	c.sendTick(nil)
+}
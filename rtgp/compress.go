@@ -0,0 +1,115 @@
+package rtgp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// When both sides agree on it during the handshake, what follows the header
+// of data packets is compressed if that makes it smaller, which is marked
+// by compressedFlag in the header. In secure mode packets are compressed
+// before they are sealed.
+//
+// The codec is a simple LZ77: runs of literal bytes, each followed by a
+// match copying length bytes from offset bytes back in the output, the
+// last run having no match. Lengths and offsets are written as uvarints.
+const (
+	compressionFlag = 1 << 0
+	compressedFlag  = 1 << 0
+
+	minMatch  = 4
+	hashBits  = 12
+	hashShift = 32 - hashBits
+)
+
+// SetCompression makes the connection ask for compressed packets when it
+// connects. It has to be called before Connect.
+func (c *Conn) SetCompression(enabled bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rAddr != nil {
+		return fmt.Errorf("connection already established")
+	}
+	c.compression = enabled
+	return nil
+}
+
+// SetCompression makes the listener agree to compress the packets of the
+// clients asking for it.
+func (l *Listener) SetCompression(enabled bool) {
+	l.endpoint.mutex.Lock()
+	l.compress = enabled
+	l.endpoint.mutex.Unlock()
+}
+
+func (c *Conn) handshakeFlags() uint8 {
+	if c.compression {
+		return compressionFlag
+	}
+	return 0
+}
+
+func hash4(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> hashShift
+}
+
+func compress(dst, src []byte) []byte {
+	var table [1 << hashBits]int32
+	lit := 0
+	for i := 0; i+minMatch <= len(src); {
+		h := hash4(src[i:])
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || binary.LittleEndian.Uint32(src[cand:]) !=
+			binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		n := minMatch
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = binary.AppendUvarint(dst, uint64(i-lit))
+		dst = append(dst, src[lit:i]...)
+		dst = binary.AppendUvarint(dst, uint64(n))
+		dst = binary.AppendUvarint(dst, uint64(i-cand))
+		i += n
+		lit = i
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(src)-lit))
+	return append(dst, src[lit:]...)
+}
+
+// decompress fails if the data would be longer than maxSize.
+func decompress(src []byte, maxSize int) ([]byte, error) {
+	dst := make([]byte, 0, maxSize)
+	for {
+		n, k := binary.Uvarint(src)
+		if k <= 0 || n > uint64(len(src)-k) || n > uint64(maxSize-len(dst)) {
+			return nil, fmt.Errorf("invalid compressed data")
+		}
+		dst = append(dst, src[k:k+int(n)]...)
+		src = src[k+int(n):]
+		if len(src) == 0 {
+			return dst, nil
+		}
+
+		length, k := binary.Uvarint(src)
+		if k <= 0 || length < minMatch ||
+			length > uint64(maxSize-len(dst)) {
+			return nil, fmt.Errorf("invalid compressed data")
+		}
+		src = src[k:]
+		offset, k := binary.Uvarint(src)
+		if k <= 0 || offset == 0 || offset > uint64(len(dst)) {
+			return nil, fmt.Errorf("invalid compressed data")
+		}
+		src = src[k:]
+		// The match can overlap the bytes it produces.
+		start := len(dst) - int(offset)
+		for j := 0; j < int(length); j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+}
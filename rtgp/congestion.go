@@ -0,0 +1,105 @@
+package rtgp
+
+import (
+	"time"
+)
+
+// When the tick rate is adaptive it is lowered by a quarter after a period
+// with too much loss or with a round-trip time well above the smallest one
+// seen, the sign that packets are queued on the path. Otherwise it is raised
+// a step each period. A period lasts two round-trip times. A packet is
+// judged lost once lossReorder packets sent after it were acked, or if it
+// is still not acked after twice the retransmission timeout, which leaves
+// time for a peer on a lower tick rate to ack it. Most of the losses of a
+// period are so known by its end.
+const (
+	minAdaptPeriod = 200 * time.Millisecond
+	lossReorder    = 3
+	lossThreshold  = 0.05
+	rttTolerance   = 50 * time.Millisecond
+	adaptSteps     = 16
+)
+
+// SetAdaptiveTickRate makes the tick rate, at which packets and periodic
+// messages are sent, vary between min and max with the congestion of the
+// link, starting from max. SetTickRate sets a fixed tick rate again.
+func (c *Conn) SetAdaptiveTickRate(min, max uint) {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	c.mutex.Lock()
+	c.minTickRate = min
+	c.maxTickRate = max
+	c.tickrate = max
+	c.resetCongestionPeriod()
+	c.mutex.Unlock()
+}
+
+func (c *Conn) resetCongestionPeriod() {
+	c.periodStart = c.now()
+	c.periodSent = 0
+	c.periodLost = 0
+}
+
+func (c *Conn) recordCongestion(lost bool) {
+	c.periodSent++
+	if lost {
+		c.periodLost++
+	}
+}
+
+// judge counts a sent packet in the congestion period, once.
+func (c *Conn) judge(p *sentPacket, lost bool) {
+	if p.time.IsZero() || p.judged {
+		return
+	}
+	p.judged = true
+	c.recordCongestion(lost)
+}
+
+func (c *Conn) judgeTimedOut() {
+	rto := 2 * c.rto()
+	now := c.now()
+	for i := range c.sentPackets {
+		p := &c.sentPackets[i]
+		if !p.acked && now.Sub(p.time) >= rto {
+			c.judge(p, true)
+		}
+	}
+}
+
+func (c *Conn) adaptTickRate() {
+	if c.maxTickRate == 0 {
+		return
+	}
+	c.judgeTimedOut()
+	period := 2 * c.stats.RTT
+	if period < minAdaptPeriod {
+		period = minAdaptPeriod
+	}
+	if c.now().Sub(c.periodStart) < period {
+		return
+	}
+
+	congested := c.periodSent > 0 &&
+		float64(c.periodLost)/float64(c.periodSent) > lossThreshold
+	if c.minRTT > 0 && c.stats.RTT > c.minRTT+c.minRTT/2+rttTolerance {
+		congested = true
+	}
+
+	if congested {
+		c.tickrate -= c.tickrate / 4
+		if c.tickrate < c.minTickRate {
+			c.tickrate = c.minTickRate
+		}
+	} else if c.periodSent > 0 {
+		c.tickrate += (c.maxTickRate-c.minTickRate)/adaptSteps + 1
+		if c.tickrate > c.maxTickRate {
+			c.tickrate = c.maxTickRate
+		}
+	}
+	c.resetCongestionPeriod()
+}
@@ -0,0 +1,39 @@
+package rtgp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTickRateFollowsLoss(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 4}}
+	clock := NewSimClock()
+	link := LinkConfig{Latency: 5 * time.Millisecond}
+	network := NewSimNetwork(link, 1, clock)
+	client, _ := newMemPair(t, network, pairConfig{}, channels, msgTypes)
+	client.SetAdaptiveTickRate(10, 100)
+	err := client.SendPeriodicMsg(0, fixedSource{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Second)
+	if r := client.Stats().TickRate; r != 100 {
+		t.Fatalf("tick rate %d without loss, want 100", r)
+	}
+
+	link.Loss = 0.3
+	network.SetLinkConfig(link)
+	clock.Advance(time.Second)
+	if r := client.Stats().TickRate; r > 50 {
+		t.Fatalf("tick rate %d after a second of loss", r)
+	}
+
+	link.Loss = 0
+	network.SetLinkConfig(link)
+	clock.Advance(5 * time.Second)
+	if r := client.Stats().TickRate; r != 100 {
+		t.Fatalf("tick rate %d once the loss stopped, want 100", r)
+	}
+}
@@ -0,0 +1,218 @@
+package rtgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+// Periodic messages are written like other messages with periodicFlag set
+// in their type, and the sequence number of the packet of their baseline
+// after their id. If it is 0 the message data follows. Otherwise the XOR of
+// the data with the baseline follows, as runs of zeros skipped and bytes
+// written. The baseline is the data of the newest message of the type the
+// peer acked, which both sides keep for deltaHistory packets. Sequence
+// numbers start at 1. Periodic messages that are fragmented are written
+// like other messages.
+const periodicFlag = 0x4000
+
+const (
+	deltaHistory = 64
+
+	// Runs of zeros shorter than this are written with the bytes around
+	// them, skipping them would take more space.
+	minDeltaSkip = 3
+)
+
+type baseline struct {
+	seq  uint32
+	data []byte
+}
+
+func (p *periodicMsg) recordSent(seq uint32, d []byte) {
+	b := &p.sent[p.nextSent%deltaHistory]
+	b.seq = seq
+	b.data = append(b.data[:0], d...)
+	p.nextSent++
+}
+
+func (c *Conn) packetAcked(seq uint32) bool {
+	p := c.sentPackets[seq%sentHistory]
+	return p.seq == seq && p.acked
+}
+
+// deltaBase returns the newest data of p the peer acked. The peer keeps it
+// until it receives a message of the type deltaHistory packets after it,
+// which is checked against the messages sent since.
+func (c *Conn) deltaBase(p *periodicMsg) (uint32, []byte) {
+	newest := p.sent[(p.nextSent+deltaHistory-1)%deltaHistory].seq
+	for k := 1; k <= deltaHistory; k++ {
+		b := p.sent[(p.nextSent+deltaHistory-k)%deltaHistory]
+		if b.seq == 0 || newest-b.seq >= deltaHistory {
+			break
+		}
+		if c.packetAcked(b.seq) {
+			return b.seq, b.data
+		}
+	}
+	return 0, nil
+}
+
+func xorBase(x, base []byte) {
+	for i := 0; i < len(x) && i < len(base); i++ {
+		x[i] ^= base[i]
+	}
+}
+
+// encodePeriodic returns the entry of the periodic message p with data d,
+// written as a delta if that is smaller, or nil if it does not fit in one
+// entry.
+func (c *Conn) encodePeriodic(p *periodicMsg, d []byte, msgID uint32) []byte {
+	var full bytes.Buffer
+	c.writePeriodicHeader(&full, p.msgType, msgID, 0)
+	if c.msgTypes[p.msgType].Variable {
+		err := binary.Write(&full, binary.LittleEndian, uint16(len(d)))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	full.Write(d)
+	if full.Len() > maxEntrySize {
+		return nil
+	}
+
+	baseSeq, base := c.deltaBase(p)
+	if base == nil {
+		return full.Bytes()
+	}
+	var delta bytes.Buffer
+	c.writePeriodicHeader(&delta, p.msgType, msgID, baseSeq)
+	err := binary.Write(&delta, binary.LittleEndian, uint16(len(d)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	x := make([]byte, len(d))
+	copy(x, d)
+	xorBase(x, base)
+	encodeDelta(&delta, x)
+	if delta.Len() >= full.Len() {
+		return full.Bytes()
+	}
+	return delta.Bytes()
+}
+
+func (c *Conn) writePeriodicHeader(data *bytes.Buffer, msgType uint16,
+	msgID uint32, baseSeq uint32) {
+	err := binary.Write(data, binary.LittleEndian, msgType|periodicFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.typeChannels[msgType].delivery != Unreliable {
+		err = binary.Write(data, binary.LittleEndian, msgID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = binary.Write(data, binary.LittleEndian, baseSeq)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func encodeDelta(data *bytes.Buffer, x []byte) {
+	var v [binary.MaxVarintLen64]byte
+	for i := 0; i < len(x); {
+		start := i
+		for i < len(x) && x[i] == 0 {
+			i++
+		}
+		skip := i - start
+
+		start = i
+		for i < len(x) {
+			if x[i] != 0 {
+				i++
+				continue
+			}
+			j := i
+			for j < len(x) && x[j] == 0 {
+				j++
+			}
+			if j == len(x) || j-i >= minDeltaSkip {
+				break
+			}
+			i = j
+		}
+		data.Write(v[:binary.PutUvarint(v[:], uint64(skip))])
+		data.Write(v[:binary.PutUvarint(v[:], uint64(i-start))])
+		data.Write(x[start:i])
+	}
+}
+
+// readDelta reads the XOR of the data of a message of type t with its
+// baseline.
+func readDelta(data *bytes.Reader, t MsgType) ([]byte, error) {
+	var size uint16
+	err := binary.Read(data, binary.LittleEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if int(size) > t.Size || !t.Variable && int(size) != t.Size {
+		return nil, fmt.Errorf("invalid delta size")
+	}
+
+	x := make([]byte, size)
+	for i := uint64(0); i < uint64(size); {
+		skip, err := binary.ReadUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		n, err := binary.ReadUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if skip+n == 0 || skip > uint64(size)-i ||
+			n > uint64(size)-i-skip {
+			return nil, fmt.Errorf("invalid delta")
+		}
+		i += skip
+		if uint64(data.Len()) < n {
+			return nil, fmt.Errorf("truncated delta")
+		}
+		data.Read(x[i : i+n])
+		i += n
+	}
+	return x, nil
+}
+
+// applyDeltas rebuilds the data of the periodic messages of packet seq
+// written as deltas, and keeps the data of all of them as baselines.
+// Messages whose baseline is not kept anymore are dropped.
+func (c *Conn) applyDeltas(entries []entry, seq uint32) []entry {
+	kept := entries[:0]
+	for _, e := range entries {
+		if !e.periodic {
+			kept = append(kept, e)
+			continue
+		}
+
+		history := c.rBaselines[e.msgType]
+		if history == nil {
+			history = make([]baseline, deltaHistory)
+			c.rBaselines[e.msgType] = history
+		}
+		if e.baseSeq != 0 {
+			b := history[e.baseSeq%deltaHistory]
+			if b.seq != e.baseSeq {
+				continue
+			}
+			xorBase(e.data, b.data)
+		}
+		b := &history[seq%deltaHistory]
+		b.seq = seq
+		b.data = append(b.data[:0], e.data...)
+		kept = append(kept, e)
+	}
+	return kept
+}
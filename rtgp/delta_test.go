@@ -0,0 +1,163 @@
+package rtgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestDeltaCodec(t *testing.T) {
+	fixed := func(n int) MsgType { return MsgType{Size: n} }
+	variable := MsgType{Size: 400, Variable: true}
+	pattern := func(n int) []byte {
+		x := make([]byte, n)
+		for i := range x {
+			if i%7 < 3 {
+				x[i] = byte(i)
+			}
+		}
+		return x
+	}
+	tests := []struct {
+		name string
+		x    []byte
+		t    MsgType
+		size int
+	}{
+		{"empty", []byte{}, variable, 0},
+		{"empty fixed", []byte{}, fixed(0), 0},
+		{"all zeros", make([]byte, 16), fixed(16), 2},
+		{"no zeros", []byte{1, 2, 3}, fixed(3), 5},
+		{"short zero runs", []byte{1, 0, 2, 0, 0, 3}, fixed(6), 8},
+		{"skipped zero run", []byte{1, 2, 0, 0, 0, 3}, fixed(6), 7},
+		{"leading zero run", []byte{0, 0, 0, 0, 5}, fixed(5), 3},
+		{"trailing zero run", []byte{1, 2, 0, 0}, fixed(4), 6},
+		{"long zero run", append(make([]byte, 300), 1), fixed(301), 4},
+		{"variable 1", pattern(1), variable, 2},
+		{"variable 10", pattern(10), variable, 9},
+		// A run of 2 bytes, then 56 runs of 3 and one of 1.
+		{"variable 400", pattern(400), variable, 4 + 56*5 + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := binary.Write(&b, binary.LittleEndian, uint16(len(tt.x)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			encodeDelta(&b, tt.x)
+			if n := b.Len() - 2; n != tt.size {
+				t.Errorf("encoded in %d bytes, want %d", n, tt.size)
+			}
+
+			r := bytes.NewReader(b.Bytes())
+			x, err := readDelta(r, tt.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(x, tt.x) {
+				t.Fatalf("decoded %v, want %v", x, tt.x)
+			}
+			if r.Len() != 0 {
+				t.Fatalf("%d bytes left", r.Len())
+			}
+		})
+	}
+}
+
+// A tickSource makes a new snapshot on every tick, most of its bytes
+// unchanged from the last one. Its snapshots start with their number, the
+// rest being derived from it.
+type tickSource struct {
+	variable bool
+	n        uint32
+}
+
+func tickSnapshot(dst []byte, n uint32, variable bool) []byte {
+	size := 64
+	if variable {
+		size = 8 + int(n/8%32)
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, n)
+	for i := 4; i < size; i++ {
+		dst = append(dst, byte(i*7)+byte(n/16))
+	}
+	return dst
+}
+
+func (s *tickSource) Snapshot(dst []byte) []byte {
+	s.n++
+	return tickSnapshot(dst, s.n, s.variable)
+}
+
+func TestPeriodicOverLossyLink(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 64}, {Size: 40, Variable: true}}
+
+	for _, pc := range pairConfigs {
+		t.Run(pc.name, func(t *testing.T) {
+			clock := NewSimClock()
+			network := NewSimNetwork(lossyLink, 1, clock)
+			client, server := newMemPair(t, network, pc.cfg, channels,
+				msgTypes)
+			for i := range msgTypes {
+				source := &tickSource{variable: msgTypes[i].Variable}
+				err := client.SendPeriodicMsg(uint16(i), source)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recved := make([]int, len(msgTypes))
+			for i := 0; i < 300; i++ {
+				clock.Advance(10 * time.Millisecond)
+				for {
+					msgType, data, ok := server.TryRecvMsg()
+					if !ok {
+						break
+					}
+					n := binary.LittleEndian.Uint32(data)
+					want := tickSnapshot(nil, n,
+						msgTypes[msgType].Variable)
+					if !bytes.Equal(data, want) {
+						t.Fatalf("type %d snapshot %d is %v, want %v",
+							msgType, n, data, want)
+					}
+					recved[msgType]++
+				}
+			}
+			for msgType, n := range recved {
+				if n < 150 {
+					t.Fatalf("%d snapshots of type %d received", n,
+						msgType)
+				}
+			}
+		})
+	}
+}
+
+func TestPeriodicUnchangedShrinks(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 1000}}
+	clock := NewSimClock()
+	network := NewSimNetwork(LinkConfig{Latency: 5 * time.Millisecond}, 1,
+		clock)
+	client, _ := newMemPair(t, network, pairConfig{}, channels, msgTypes)
+	err := client.SendPeriodicMsg(0, fixedSource(bytes.Repeat([]byte{7}, 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	before := client.Stats()
+	clock.Advance(time.Second)
+	after := client.Stats()
+	packets := after.PacketsSent - before.PacketsSent
+	if packets < 90 {
+		t.Fatalf("%d packets sent in a second", packets)
+	}
+	if n := after.BytesSent - before.BytesSent; n > 50*packets {
+		t.Fatalf("%d bytes sent in %d packets", n, packets)
+	}
+}
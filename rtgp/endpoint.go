@@ -0,0 +1,463 @@
+package rtgp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// An Endpoint owns a PacketConn and dispatches the packets read from it to
+// the connections made or accepted on it.
+type Endpoint struct {
+	mutex        sync.Mutex
+	conn         PacketConn
+	challengeKey []byte
+	conns        map[string]*Conn
+	sessions     map[uint32]*Conn
+	listener     *Listener
+	clock        *SimClock
+	closed       bool
+	recvDone     chan struct{}
+	stats        EndpointStats
+}
+
+// PacketsRejected counts the packets that were malformed, of an unknown
+// kind, or not for any connection or session of the endpoint.
+type EndpointStats struct {
+	PacketsRecved   uint64
+	PacketsRejected uint64
+}
+
+func (e *Endpoint) Stats() EndpointStats {
+	e.mutex.Lock()
+	stats := e.stats
+	e.mutex.Unlock()
+	return stats
+}
+
+func (e *Endpoint) recordPacket(accepted bool) {
+	e.mutex.Lock()
+	e.stats.PacketsRecved++
+	if !accepted {
+		e.stats.PacketsRejected++
+	}
+	e.mutex.Unlock()
+}
+
+func NewEndpoint(pc PacketConn) (*Endpoint, error) {
+	e := new(Endpoint)
+	e.conn = pc
+	e.challengeKey = make([]byte, sha256.Size)
+	_, err := rand.Read(e.challengeKey)
+	if err != nil {
+		return nil, err
+	}
+	e.conns = make(map[string]*Conn)
+	e.sessions = make(map[uint32]*Conn)
+	e.recvDone = make(chan struct{})
+
+	if spc, ok := pc.(simPacketConn); ok && spc.simClock() != nil {
+		e.clock = spc.simClock()
+		spc.setHandler(e.recvPacket)
+		close(e.recvDone)
+		return e, nil
+	}
+	go recvUDP(e)
+	return e, nil
+}
+
+func NewUDPEndpoint(lAddr string) (*Endpoint, error) {
+	pc, err := ListenUDP(lAddr)
+	if err != nil {
+		return nil, err
+	}
+	e, err := NewEndpoint(pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close closes the listener and the connections of the endpoint, then its
+// PacketConn.
+func (e *Endpoint) Close() error {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return fmt.Errorf("endpoint already closed")
+	}
+	e.closed = true
+	l := e.listener
+	conns := make([]*Conn, 0, len(e.sessions))
+	for _, c := range e.sessions {
+		conns = append(conns, c)
+	}
+	e.mutex.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+
+	err := e.conn.Close()
+	<-e.recvDone
+	return err
+}
+
+func (e *Endpoint) LocalAddr() net.Addr {
+	return e.conn.LocalAddr()
+}
+
+func (e *Endpoint) localPort() int {
+	if addr, ok := e.conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+func (e *Endpoint) NewConn(channels []Channel, msgTypes []MsgType,
+	tickrate uint) (*Conn, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil, fmt.Errorf("endpoint closed")
+	}
+	return e.newConn(channels, msgTypes, tickrate)
+}
+
+// Connections are also found by their local session id, which is unique
+// on an endpoint, so that they can be moved when the address of their peer
+// changes.
+func (e *Endpoint) newConn(channels []Channel, msgTypes []MsgType,
+	tickrate uint) (*Conn, error) {
+	for {
+		c, err := newConn(e, channels, msgTypes, tickrate)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := e.sessions[c.lSessionID]; !found {
+			e.sessions[c.lSessionID] = c
+			return c, nil
+		}
+	}
+}
+
+func (e *Endpoint) addConn(rAddr net.Addr, c *Conn) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return fmt.Errorf("endpoint closed")
+	}
+	if _, found := e.conns[addrKey(rAddr)]; found {
+		return fmt.Errorf("already connected to %s", rAddr)
+	}
+	e.conns[addrKey(rAddr)] = c
+	return nil
+}
+
+func (e *Endpoint) removeConn(rAddr net.Addr, c *Conn) {
+	e.mutex.Lock()
+	if rAddr != nil && e.conns[addrKey(rAddr)] == c {
+		delete(e.conns, addrKey(rAddr))
+	}
+	if e.sessions[c.lSessionID] == c {
+		delete(e.sessions, c.lSessionID)
+	}
+	e.mutex.Unlock()
+}
+
+// moveConn moves c from the address of its peer to rAddr.
+func (e *Endpoint) moveConn(c *Conn, rAddr net.Addr) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if other, found := e.conns[addrKey(rAddr)]; found && other != c {
+		return fmt.Errorf("already connected to %s", rAddr)
+	}
+	if e.conns[addrKey(c.rAddr)] == c {
+		delete(e.conns, addrKey(c.rAddr))
+	}
+	e.conns[addrKey(rAddr)] = c
+	return nil
+}
+
+func (e *Endpoint) sessionConn(packet []byte) (*Conn, bool) {
+	if len(packet) < 1+4 {
+		return nil, false
+	}
+	e.mutex.Lock()
+	c, found := e.sessions[binary.LittleEndian.Uint32(packet[1:])]
+	e.mutex.Unlock()
+	return c, found
+}
+
+const acceptBacklog = 16
+
+type Listener struct {
+	endpoint *Endpoint
+	channels []Channel
+	msgTypes []MsgType
+	tickrate uint
+	key      *ecdh.PrivateKey
+	compress bool
+	accepted chan *Conn
+	closed   chan struct{}
+}
+
+func (e *Endpoint) Listen(channels []Channel, msgTypes []MsgType,
+	tickrate uint) (*Listener, error) {
+	return e.listen(channels, msgTypes, tickrate, nil)
+}
+
+// ListenSecure only accepts clients connecting with ConnectSecure and the
+// public key of key, the X25519 static key of the server.
+func (e *Endpoint) ListenSecure(channels []Channel, msgTypes []MsgType,
+	tickrate uint, key *ecdh.PrivateKey) (*Listener, error) {
+	if key == nil || key.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("invalid key")
+	}
+	return e.listen(channels, msgTypes, tickrate, key)
+}
+
+func (e *Endpoint) listen(channels []Channel, msgTypes []MsgType,
+	tickrate uint, key *ecdh.PrivateKey) (*Listener, error) {
+	_, _, err := newChannels(channels, msgTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(Listener)
+	l.endpoint = e
+	l.channels = channels
+	l.msgTypes = msgTypes
+	l.tickrate = tickrate
+	l.key = key
+	l.accepted = make(chan *Conn, acceptBacklog)
+	l.closed = make(chan struct{})
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil, fmt.Errorf("endpoint closed")
+	}
+	if e.listener != nil {
+		return nil, fmt.Errorf("already listening on %s", e.LocalAddr())
+	}
+	e.listener = l
+	return l, nil
+}
+
+func (l *Listener) Accept() (*Conn, error) {
+	if clock := l.endpoint.clock; clock != nil {
+		clock.runUntil(func() bool {
+			return len(l.accepted) > 0 || isClosed(l.closed)
+		}, 0)
+	}
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+// Close stops accepting connections, the connections already accepted are
+// left open.
+func (l *Listener) Close() error {
+	e := l.endpoint
+	e.mutex.Lock()
+	if e.listener != l {
+		e.mutex.Unlock()
+		return fmt.Errorf("listener already closed")
+	}
+	e.listener = nil
+	close(l.closed)
+	e.mutex.Unlock()
+
+	for {
+		select {
+		case c := <-l.accepted:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *Listener) LocalPort() int {
+	return l.endpoint.localPort()
+}
+
+func (l *Listener) LocalAddr() net.Addr {
+	return l.endpoint.LocalAddr()
+}
+
+// In secure mode, extra holds the keys exchanged during the handshake.
+func encodeHandshake(kind uint8, p handshakePacket, extra []byte) []byte {
+	var data bytes.Buffer
+	data.WriteByte(kind)
+	err := binary.Write(&data, binary.LittleEndian, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data.Write(extra)
+	return data.Bytes()
+}
+
+func (e *Endpoint) sendHandshake(raddr net.Addr, kind uint8,
+	p handshakePacket, extra []byte) {
+	e.conn.WriteTo(encodeHandshake(kind, p, extra), raddr)
+}
+
+func (e *Endpoint) challengeFor(raddr net.Addr, clientSessionID uint32) uint32 {
+	mac := hmac.New(sha256.New, e.challengeKey)
+	mac.Write([]byte(addrKey(raddr)))
+	binary.Write(mac, binary.LittleEndian, clientSessionID)
+	return binary.LittleEndian.Uint32(mac.Sum(nil))
+}
+
+func (e *Endpoint) handleHandshake(raddr net.Addr, kind uint8,
+	p handshakePacket, extra []byte) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	l := e.listener
+	if l == nil {
+		return false
+	}
+
+	switch kind {
+	case connectRequestPacket:
+		if len(extra) != 0 {
+			return false
+		}
+		// The challenge is derived from the client address so that no
+		// state is kept until the client proves it owns that address.
+		challenge := e.challengeFor(raddr, p.ClientSessionID)
+		e.sendHandshake(raddr, challengePacket,
+			handshakePacket{p.ClientSessionID, 0, challenge, 0}, nil)
+	case challengeResponsePacket:
+		if p.Challenge != e.challengeFor(raddr, p.ClientSessionID) {
+			return false
+		}
+		if l.key == nil && len(extra) != 0 ||
+			l.key != nil && len(extra) != keySize ||
+			p.Flags&^compressionFlag != 0 {
+			return false
+		}
+		// Let the client retry once Accept has drained the backlog.
+		if len(l.accepted) == cap(l.accepted) {
+			break
+		}
+		// The connection may have been added since the packet was
+		// dispatched.
+		if _, found := e.conns[addrKey(raddr)]; found {
+			break
+		}
+
+		c, err := e.newConn(l.channels, l.msgTypes, l.tickrate)
+		if err != nil {
+			break
+		}
+
+		c.compression = l.compress && p.Flags&compressionFlag != 0
+		accept := handshakePacket{p.ClientSessionID, c.lSessionID, 0,
+			c.handshakeFlags()}
+		if l.key != nil {
+			c.session, c.acceptExtra, err = serverHandshake(l.key,
+				accept, extra)
+			if err != nil {
+				delete(e.sessions, c.lSessionID)
+				return false
+			}
+			c.rKey = append([]byte(nil), extra...)
+		}
+
+		c.mutex.Lock()
+		c.rAddr = raddr
+		c.rSessionID = p.ClientSessionID
+		e.conns[addrKey(raddr)] = c
+		c.sendHandshake(connectAcceptPacket, accept, c.acceptExtra)
+		c.establish()
+		c.mutex.Unlock()
+		l.accepted <- c
+	default:
+		return false
+	}
+	return true
+}
+
+// handlePacket returns false if the packet was rejected.
+func (e *Endpoint) handlePacket(c *Conn, found bool, raddr net.Addr,
+	packet []byte) bool {
+	data := bytes.NewReader(packet)
+	kind, err := data.ReadByte()
+	if err != nil {
+		return false
+	}
+
+	if !found {
+		// The address of the peer may have changed.
+		switch kind {
+		case dataPacket:
+			c, found = e.sessionConn(packet)
+			return found && c.handleMovedPacket(raddr, packet)
+		case pathResponsePacket:
+			c, found = e.sessionConn(packet)
+			return found && c.handlePathResponse(raddr, packet)
+		}
+	}
+
+	switch kind {
+	case dataPacket:
+		return found && c.handleDataPacket(packet)
+	case disconnectPacket:
+		return found && c.handleDisconnect(packet)
+	case pathChallengePacket:
+		return found && c.handlePathChallenge(packet)
+	case connectRequestPacket, challengePacket, challengeResponsePacket,
+		connectAcceptPacket:
+	default:
+		return false
+	}
+
+	var p handshakePacket
+	err = binary.Read(data, binary.LittleEndian, &p)
+	if err != nil {
+		return false
+	}
+	extra := packet[len(packet)-data.Len():]
+	if found {
+		return c.handleHandshake(kind, p, extra)
+	}
+	return e.handleHandshake(raddr, kind, p, extra)
+}
+
+func (e *Endpoint) recvPacket(packet []byte, raddr net.Addr) {
+	e.mutex.Lock()
+	c, found := e.conns[addrKey(raddr)]
+	e.mutex.Unlock()
+
+	e.recordPacket(e.handlePacket(c, found, raddr, packet))
+}
+
+func recvUDP(e *Endpoint) {
+	packetData := make([]byte, maxSealedPacketSize)
+
+	for {
+		n, raddr, err := e.conn.ReadFrom(packetData)
+		if err != nil {
+			break
+		}
+		e.recvPacket(packetData[:n], raddr)
+	}
+	close(e.recvDone)
+}
@@ -0,0 +1,167 @@
+package rtgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+// Messages that do not fit in a packet are split into fragments. A fragment
+// is written like a message whose type has fragmentFlag set, followed by a
+// fragmentHeader and the fragment data.
+const fragmentFlag = 0x8000
+
+type fragmentHeader struct {
+	ID    uint32
+	Index uint16
+	Count uint16
+	Size  uint16
+}
+
+const fragmentHeaderSize = 10
+
+const (
+	maxFragments = 1024
+	fragmentSize = maxEntrySize - 2 - fragmentHeaderSize
+	maxMsgSize   = maxFragments * fragmentSize
+
+	// Number of unreliable messages that can be reassembled at the same
+	// time, older ones are dropped.
+	maxRFragmented = 8
+)
+
+type fragmentedMsg struct {
+	fragments [][]byte
+	recved    int
+	size      int
+}
+
+// For reliable and sequenced messages, msgID identifies the message and its
+// fragments. Unreliable messages are only given an id if they are
+// fragmented.
+func (c *Conn) encodeMsg(m msg, msgID uint32) [][]byte {
+	var entry bytes.Buffer
+	c.writeMsg(&entry, m, msgID)
+	if entry.Len() <= maxEntrySize {
+		return [][]byte{entry.Bytes()}
+	}
+
+	if ch := c.typeChannels[m.msgType]; ch.delivery == Unreliable {
+		msgID = ch.nextMsgID
+		ch.nextMsgID++
+	}
+	return encodeFragments(m, msgID)
+}
+
+func encodeFragments(m msg, id uint32) [][]byte {
+	count := (len(m.data) + fragmentSize - 1) / fragmentSize
+	fragments := make([][]byte, count)
+	for i := range fragments {
+		d := m.data[i*fragmentSize:]
+		if len(d) > fragmentSize {
+			d = d[:fragmentSize]
+		}
+
+		var entry bytes.Buffer
+		err := binary.Write(&entry, binary.LittleEndian, m.msgType|fragmentFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		header := fragmentHeader{id, uint16(i), uint16(count), uint16(len(d))}
+		err = binary.Write(&entry, binary.LittleEndian, header)
+		if err != nil {
+			log.Fatal(err)
+		}
+		entry.Write(d)
+		fragments[i] = entry.Bytes()
+	}
+	return fragments
+}
+
+// readFragment reads the header and the data of a fragment of a message of
+// type t, checking that they match how the message would be split.
+func readFragment(data *bytes.Reader, t MsgType) (header fragmentHeader,
+	d []byte, err error) {
+	err = binary.Read(data, binary.LittleEndian, &header)
+	if err != nil {
+		return
+	}
+	if header.Count == 0 || header.Count > maxFragments ||
+		header.Index >= header.Count || header.Size > fragmentSize ||
+		header.Index < header.Count-1 && header.Size != fragmentSize ||
+		int(header.Count-1)*fragmentSize >= t.Size {
+		err = fmt.Errorf("invalid fragment")
+		return
+	}
+	if data.Len() < int(header.Size) {
+		err = fmt.Errorf("truncated fragment")
+		return
+	}
+	d = make([]byte, header.Size)
+	data.Read(d)
+	return
+}
+
+// addFragment returns the reassembled message once its last missing
+// fragment has been added.
+func (c *Conn) addFragment(e entry) (m msg, complete bool) {
+	header := e.fragment
+	t := c.msgTypes[e.msgType]
+	ch := c.typeChannels[e.msgType]
+	fragmented := ch.rFragmented
+	if ch.reliable() {
+		if !ch.isNewRMsgID(header.ID) {
+			return
+		}
+	} else {
+		if len(fragmented) == 0 || header.ID-ch.rFragNewest < 1<<31 {
+			ch.rFragNewest = header.ID
+		}
+		if ch.rFragNewest-header.ID >= maxRFragmented {
+			return
+		}
+	}
+
+	f, found := fragmented[header.ID]
+	if !found {
+		f = &fragmentedMsg{make([][]byte, header.Count), 0, 0}
+		fragmented[header.ID] = f
+		if !ch.reliable() {
+			dropOldFragmented(fragmented, ch.rFragNewest)
+		}
+	}
+	if len(f.fragments) != int(header.Count) {
+		delete(fragmented, header.ID)
+		return
+	}
+	if f.fragments[header.Index] != nil {
+		return
+	}
+	f.fragments[header.Index] = e.data
+	f.recved++
+	f.size += len(e.data)
+	if f.size > t.Size {
+		delete(fragmented, header.ID)
+		return
+	}
+	if f.recved < len(f.fragments) {
+		return
+	}
+
+	delete(fragmented, header.ID)
+	if !t.Variable && f.size != t.Size {
+		return
+	}
+	m.msgType = e.msgType
+	m.data = bytes.Join(f.fragments, nil)
+	return m, true
+}
+
+func dropOldFragmented(fragmented map[uint32]*fragmentedMsg, newest uint32) {
+	for id := range fragmented {
+		if newest-id >= maxRFragmented {
+			delete(fragmented, id)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package rtgp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var fuzzChannels = []Channel{
+	{"", Unreliable},
+	{"unordered", ReliableUnordered},
+	{"ordered", ReliableOrdered},
+	{"sequenced", Sequenced},
+}
+
+var fuzzMsgTypes = []MsgType{
+	{Size: 4},
+	{Size: 64, Variable: true, Channel: "ordered"},
+	{Size: 3000, Variable: true, Channel: "unordered"},
+	{Size: 8, Channel: "sequenced"},
+	{Size: 32, Variable: true, Channel: "sequenced"},
+}
+
+// FuzzHandlePacket feeds packets to an endpoint listening with compression,
+// from the peer of an established connection that agreed on compression,
+// then from an unknown address. The connection has an extra message type
+// of the given size, on the unreliable channel, and is not made if its
+// size is rejected. A zero session id in data, disconnect and path packets
+// is replaced with the one of the connection, so that the corpus does not
+// depend on it.
+func FuzzHandlePacket(f *testing.F) {
+	network := NewMemNetwork(LinkConfig{}, 1)
+	pc, err := network.Listen("server")
+	if err != nil {
+		f.Fatal(err)
+	}
+	e, err := NewEndpoint(pc)
+	if err != nil {
+		f.Fatal(err)
+	}
+	// Only the PacketConn is closed, closing the connections would wait
+	// for the lock of one that panicked.
+	f.Cleanup(func() { pc.Close() })
+	l, err := e.Listen(fuzzChannels, fuzzMsgTypes, 100)
+	if err != nil {
+		f.Fatal(err)
+	}
+	l.SetCompression(true)
+	peer := memAddr("peer")
+	other := memAddr("other")
+
+	f.Fuzz(func(t *testing.T, size int, variable bool, packet []byte) {
+		msgTypes := append(append([]MsgType(nil), fuzzMsgTypes...),
+			MsgType{Size: size, Variable: variable})
+		e.mutex.Lock()
+		c, err := e.newConn(fuzzChannels, msgTypes, 100)
+		if err != nil {
+			e.mutex.Unlock()
+			if size >= 0 && size <= maxMsgSize {
+				t.Fatal(err)
+			}
+			return
+		}
+		c.rAddr = peer
+		c.rSessionID = 1
+		c.compression = true
+		c.sending = true
+		c.lastRecv = time.Now()
+		// Acks of the peer are accepted up to lSeq.
+		c.lSeq = 1 << 16
+		e.conns[addrKey(peer)] = c
+		e.mutex.Unlock()
+
+		packet = append([]byte(nil), packet...)
+		if len(packet) >= 1+4 && packet[0] != connectRequestPacket &&
+			packet[0] != challengePacket &&
+			packet[0] != challengeResponsePacket &&
+			packet[0] != connectAcceptPacket &&
+			binary.LittleEndian.Uint32(packet[1:]) == 0 {
+			binary.LittleEndian.PutUint32(packet[1:], c.lSessionID)
+		}
+		e.handlePacket(c, true, peer, packet)
+		e.handlePacket(nil, false, other, packet)
+
+		c.mutex.Lock()
+		for _, m := range c.recvedMsgs {
+			if err := c.checkMsg(m.msgType, m.data); err != nil {
+				t.Errorf("invalid message delivered: %v", err)
+			}
+		}
+		c.terminate(ErrClosed)
+		c.mutex.Unlock()
+	})
+}
@@ -0,0 +1,216 @@
+package rtgp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LinkConfig describes the conditions of the links of a MemNetwork. Every
+// packet is delayed by Latency plus a random duration up to Jitter. Loss,
+// Duplicate and Reorder are the probabilities for a packet to be dropped,
+// delivered twice, or held back for ReorderDelay so that packets sent after
+// it overtake it.
+type LinkConfig struct {
+	Latency      time.Duration
+	Jitter       time.Duration
+	Loss         float64
+	Duplicate    float64
+	Reorder      float64
+	ReorderDelay time.Duration
+}
+
+// A MemNetwork is an in-memory network that PacketConns can be opened on,
+// to run connections without sockets. The random link conditions are drawn
+// from a generator seeded with the given seed. On a network made with
+// NewMemNetwork packets are delayed on real timers and connections send on
+// real tickers, so only the link decisions are reproducible. On a network
+// made with NewSimNetwork everything runs on a SimClock, and the seed
+// reproduces whole runs.
+type MemNetwork struct {
+	mutex  sync.Mutex
+	config LinkConfig
+	rand   *rand.Rand
+	clock  *SimClock
+	conns  map[string]*memPacketConn
+}
+
+const memQueueSize = 1024
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+type memPacket struct {
+	data []byte
+	from memAddr
+}
+
+type memPacketConn struct {
+	network *MemNetwork
+	addr    memAddr
+	packets chan memPacket
+	handler func(packet []byte, from net.Addr)
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func NewMemNetwork(config LinkConfig, seed int64) *MemNetwork {
+	n := new(MemNetwork)
+	n.config = config
+	n.rand = rand.New(rand.NewSource(seed))
+	n.conns = make(map[string]*memPacketConn)
+	return n
+}
+
+// NewSimNetwork returns a network whose packets are delivered by clock.
+func NewSimNetwork(config LinkConfig, seed int64, clock *SimClock) *MemNetwork {
+	n := NewMemNetwork(config, seed)
+	n.clock = clock
+	return n
+}
+
+func (n *MemNetwork) SetLinkConfig(config LinkConfig) {
+	n.mutex.Lock()
+	n.config = config
+	n.mutex.Unlock()
+}
+
+func (n *MemNetwork) Listen(addr string) (PacketConn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, found := n.conns[addr]; found {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+
+	c := new(memPacketConn)
+	c.network = n
+	c.addr = memAddr(addr)
+	c.packets = make(chan memPacket, memQueueSize)
+	c.closed = make(chan struct{})
+	n.conns[addr] = c
+	return c, nil
+}
+
+func (n *MemNetwork) send(data []byte, from memAddr, to string) {
+	n.mutex.Lock()
+	dst, found := n.conns[to]
+	config := n.config
+	copies := 1
+	if n.rand.Float64() < config.Loss {
+		copies = 0
+	} else if n.rand.Float64() < config.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = config.Latency
+		if config.Jitter > 0 {
+			delays[i] += time.Duration(n.rand.Int63n(int64(config.Jitter)))
+		}
+		if n.rand.Float64() < config.Reorder {
+			delays[i] += config.ReorderDelay
+		}
+	}
+	n.mutex.Unlock()
+
+	if !found {
+		return
+	}
+	d := make([]byte, len(data))
+	copy(d, data)
+	for _, delay := range delays {
+		if n.clock != nil {
+			n.clock.schedule(delay, func() {
+				dst.deliver(memPacket{d, from})
+			})
+		} else if delay <= 0 {
+			dst.push(memPacket{d, from})
+		} else {
+			time.AfterFunc(delay, func() {
+				dst.push(memPacket{d, from})
+			})
+		}
+	}
+}
+
+// Like a socket buffer, a full queue drops the packets.
+func (c *memPacketConn) push(p memPacket) {
+	select {
+	case <-c.closed:
+	case c.packets <- p:
+	default:
+	}
+}
+
+// deliver hands a packet of a simulated network to the endpoint of c. The
+// packet is copied as if it was read, a duplicate sharing its data.
+func (c *memPacketConn) deliver(p memPacket) {
+	c.network.mutex.Lock()
+	handler := c.handler
+	c.network.mutex.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	if handler != nil {
+		handler(append([]byte(nil), p.data...), p.from)
+	}
+}
+
+func (c *memPacketConn) simClock() *SimClock {
+	return c.network.clock
+}
+
+func (c *memPacketConn) setHandler(handler func(packet []byte,
+	from net.Addr)) {
+	c.network.mutex.Lock()
+	c.handler = handler
+	c.network.mutex.Unlock()
+}
+
+func (c *memPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, fmt.Errorf("use of closed connection")
+	}
+}
+
+func (c *memPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, fmt.Errorf("use of closed connection")
+	default:
+	}
+	c.network.send(b, c.addr, addr.String())
+	return len(b), nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memPacketConn) ResolveAddr(addr string) (net.Addr, error) {
+	return memAddr(addr), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.mutex.Lock()
+		delete(c.network.conns, string(c.addr))
+		c.network.mutex.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,214 @@
+package rtgp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recvMemPackets sends n numbered packets from one PacketConn to another
+// on a network without latency, and returns the numbers received.
+func recvMemPackets(t *testing.T, network *MemNetwork, n int) []uint32 {
+	t.Helper()
+	a, err := network.Listen("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := network.Listen("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	to, err := a.ResolveAddr("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		var data [4]byte
+		binary.LittleEndian.PutUint32(data[:], uint32(i))
+		_, err = a.WriteTo(data[:], to)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Packets without delay are queued when they are sent.
+	var got []uint32
+	buf := make([]byte, 4)
+	for len(b.(*memPacketConn).packets) > 0 {
+		_, from, err := b.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != "a" {
+			t.Fatalf("packet from %s, want a", from)
+		}
+		got = append(got, binary.LittleEndian.Uint32(buf))
+	}
+	return got
+}
+
+func TestMemNetworkSeed(t *testing.T) {
+	link := LinkConfig{Loss: 0.3, Duplicate: 0.2}
+	const n = 500
+	first := recvMemPackets(t, NewMemNetwork(link, 42), n)
+	second := recvMemPackets(t, NewMemNetwork(link, 42), n)
+	if len(first) != len(second) {
+		t.Fatalf("received %d then %d packets with the same seed",
+			len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("packet %d is %d then %d with the same seed", i,
+				first[i], second[i])
+		}
+	}
+
+	counts := make(map[uint32]int)
+	for _, id := range first {
+		counts[id]++
+	}
+	lost, duplicated := 0, 0
+	for i := uint32(0); i < n; i++ {
+		switch counts[i] {
+		case 0:
+			lost++
+		case 2:
+			duplicated++
+		}
+	}
+	if lost == 0 || duplicated == 0 {
+		t.Fatalf("%d packets lost and %d duplicated, want some of both",
+			lost, duplicated)
+	}
+}
+
+func TestMemNetworkPartition(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 1}}
+	network := NewMemNetwork(LinkConfig{Latency: time.Millisecond}, 1)
+	client, server := newMemPair(t, network, pairConfig{}, channels, msgTypes)
+
+	err := client.SendMsg(0, []byte{1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := server.RecvMsg(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 1 {
+		t.Fatalf("got message %d, want 1", data[0])
+	}
+
+	client.SetTimeout(200 * time.Millisecond)
+	network.SetLinkConfig(LinkConfig{Loss: 1})
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not time out")
+	}
+	if client.Err() != ErrTimeout {
+		t.Fatalf("got error %v, want %v", client.Err(), ErrTimeout)
+	}
+}
+
+// simRun runs a client streaming messages to a server on a simulated lossy
+// link, and returns what the server received and when, with the stats of
+// both sides.
+func simRun(t *testing.T, seed int64) string {
+	channels := []Channel{{"ordered", ReliableOrdered}, {"state", Sequenced}}
+	msgTypes := []MsgType{{Size: 4, Channel: "ordered"},
+		{Size: 4, Channel: "state"}}
+	clock := NewSimClock()
+	network := NewSimNetwork(lossyLink, seed, clock)
+	client, server := newMemPair(t, network, pairConfig{}, channels, msgTypes)
+	client.SetAdaptiveTickRate(20, 100)
+
+	const n = 200
+	start := clock.Now()
+	var trace strings.Builder
+	var ordered []uint32
+	for i := 0; i < n+100; i++ {
+		if i < n {
+			data := make([]byte, 4)
+			binary.LittleEndian.PutUint32(data, uint32(i))
+			err := client.SendReliableMsg(0, data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.SendMsg(1, data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		clock.Advance(10 * time.Millisecond)
+		for {
+			msgType, data, ok := server.TryRecvMsg()
+			if !ok {
+				break
+			}
+			id := binary.LittleEndian.Uint32(data)
+			if msgType == 0 {
+				ordered = append(ordered, id)
+			}
+			fmt.Fprintln(&trace, clock.Now().Sub(start), msgType, id)
+		}
+	}
+	fmt.Fprintf(&trace, "%+v\n%+v\n", client.Stats(), server.Stats())
+
+	if len(ordered) != n {
+		t.Fatalf("%d reliable messages received, want %d", len(ordered), n)
+	}
+	for i, id := range ordered {
+		if id != uint32(i) {
+			t.Fatalf("got message %d, want %d", id, i)
+		}
+	}
+	return trace.String()
+}
+
+func TestSimNetworkReproducible(t *testing.T) {
+	first := simRun(t, 1)
+	if second := simRun(t, 1); second != first {
+		t.Fatalf("runs with the same seed differ:\n%s\n%s", first, second)
+	}
+	if other := simRun(t, 2); other == first {
+		t.Fatal("runs with different seeds are the same")
+	}
+}
+
+func TestSimNetworkConnectTimeout(t *testing.T) {
+	clock := NewSimClock()
+	network := NewSimNetwork(LinkConfig{}, 1, clock)
+	pc, err := network.Listen("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEndpoint(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	c, err := e.NewConn([]Channel{{"", Unreliable}}, []MsgType{{Size: 1}},
+		100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := clock.Now()
+	err = c.Connect("nobody")
+	if err != ErrTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrTimeout)
+	}
+	if d := clock.Now().Sub(start); d != connectTimeout {
+		t.Fatalf("timed out after %v, want %v", d, connectTimeout)
+	}
+}
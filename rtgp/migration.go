@@ -0,0 +1,136 @@
+package rtgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// When a valid data packet of a connection comes from a new address, a
+// challenge is sent there. The connection only moves to that address once
+// the challenge is sent back from it, which proves that the peer can be
+// reached there. Until then packets from the new address are ignored.
+//
+// Only secure connections move. Their packets are sealed, so only the peer
+// can send a data packet or answer a challenge. In plaintext mode anyone
+// who sees the session id could send both, and take the connection.
+type pathPacket struct {
+	SessionID uint32
+	Seq       uint32
+	Challenge uint64
+}
+
+const (
+	pathPacketSize       = 1 + 16
+	pathPacketHeaderSize = 1 + 8
+
+	pathChallengePeriod = 100 * time.Millisecond
+)
+
+func (c *Conn) sendPathPacket(kind uint8, rAddr net.Addr, challenge uint64) {
+	c.lSeq++
+	p := pathPacket{c.rSessionID, c.lSeq, challenge}
+	var data bytes.Buffer
+	data.WriteByte(kind)
+	err := binary.Write(&data, binary.LittleEndian, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	packet := c.session.sealPacket(data.Bytes(), pathPacketHeaderSize, p.Seq)
+	c.endpoint.conn.WriteTo(packet, rAddr)
+}
+
+func (c *Conn) readPathPacket(packet []byte) (p pathPacket, err error) {
+	if len(packet) != pathPacketSize+sealOverhead {
+		return p, fmt.Errorf("invalid path packet")
+	}
+	seq := binary.LittleEndian.Uint32(packet[5:])
+	packet, err = c.session.openPacket(packet, pathPacketHeaderSize, seq)
+	if err != nil {
+		return
+	}
+	err = binary.Read(bytes.NewReader(packet[1:]), binary.LittleEndian, &p)
+	if err == nil && p.SessionID != c.lSessionID {
+		err = fmt.Errorf("invalid session")
+	}
+	return
+}
+
+// handleMovedPacket handles a data packet of the session coming from an
+// address that is not the one of the peer.
+func (c *Conn) handleMovedPacket(rAddr net.Addr, packet []byte) bool {
+	var header packetHeader
+	err := binary.Read(bytes.NewReader(packet[1:]), binary.LittleEndian,
+		&header)
+	if err != nil {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.sending || c.session == nil || header.SessionID != c.lSessionID {
+		return false
+	}
+	_, err = c.session.openPacket(packet, packetHeaderSize, header.LSeq)
+	if err != nil {
+		c.stats.PacketsRejected++
+		return false
+	}
+
+	if c.now().Sub(c.pathSent) < pathChallengePeriod {
+		return true
+	}
+	var b [8]byte
+	_, err = rand.Read(b[:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.pathAddr = rAddr
+	c.pathNonce = binary.LittleEndian.Uint64(b[:])
+	c.pathSent = c.now()
+	c.sendPathPacket(pathChallengePacket, rAddr, c.pathNonce)
+	return true
+}
+
+func (c *Conn) handlePathChallenge(packet []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.sending || c.session == nil {
+		return false
+	}
+	p, err := c.readPathPacket(packet)
+	if err != nil {
+		c.stats.PacketsRejected++
+		return false
+	}
+	c.sendPathPacket(pathResponsePacket, c.rAddr, p.Challenge)
+	return true
+}
+
+func (c *Conn) handlePathResponse(rAddr net.Addr, packet []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.sending || c.pathAddr == nil ||
+		addrKey(rAddr) != addrKey(c.pathAddr) {
+		return false
+	}
+	p, err := c.readPathPacket(packet)
+	if err != nil || p.Challenge != c.pathNonce {
+		c.stats.PacketsRejected++
+		return false
+	}
+
+	err = c.endpoint.moveConn(c, rAddr)
+	if err != nil {
+		return false
+	}
+	c.rAddr = rAddr
+	c.pathAddr = nil
+	c.lastRecv = c.now()
+	c.stats.Migrations++
+	return true
+}
@@ -0,0 +1,215 @@
+package rtgp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A rebindingConn is a PacketConn whose address changes, as a client behind
+// a NAT whose mapping is renewed. It receives on all its addresses.
+type rebindingConn struct {
+	mutex   sync.Mutex
+	current PacketConn
+	conns   []PacketConn
+	packets chan memPacket
+	closed  chan struct{}
+}
+
+func newRebindingConn(t *testing.T, network *MemNetwork,
+	addrs ...string) *rebindingConn {
+	c := &rebindingConn{
+		packets: make(chan memPacket, memQueueSize),
+		closed:  make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		pc, err := network.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.conns = append(c.conns, pc)
+		go func(pc PacketConn) {
+			b := make([]byte, maxSealedPacketSize)
+			for {
+				n, from, err := pc.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				c.packets <- memPacket{append([]byte(nil), b[:n]...),
+					from.(memAddr)}
+			}
+		}(pc)
+	}
+	c.current = c.conns[0]
+	return c
+}
+
+func (c *rebindingConn) rebind(i int) {
+	c.mutex.Lock()
+	c.current = c.conns[i]
+	c.mutex.Unlock()
+}
+
+func (c *rebindingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *rebindingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	current := c.current
+	c.mutex.Unlock()
+	return current.WriteTo(b, addr)
+}
+
+func (c *rebindingConn) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current.LocalAddr()
+}
+
+func (c *rebindingConn) ResolveAddr(addr string) (net.Addr, error) {
+	return memAddr(addr), nil
+}
+
+func (c *rebindingConn) Close() error {
+	close(c.closed)
+	for _, pc := range c.conns {
+		pc.Close()
+	}
+	return nil
+}
+
+func TestMigration(t *testing.T) {
+	channels := []Channel{{"", ReliableOrdered}}
+	msgTypes := []MsgType{{Size: 1}}
+	network := NewMemNetwork(LinkConfig{Latency: time.Millisecond}, 1)
+	spc, err := network.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	se, err := NewEndpoint(spc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := se.ListenSecure(channels, msgTypes, 100, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nat := newRebindingConn(t, network, "client", "rebound")
+	ce, err := NewEndpoint(nat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ce.Close()
+	client, err := ce.NewConn(channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.ConnectSecure("server", key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			nat.rebind(1)
+		}
+		err = client.SendReliableMsg(0, []byte{byte(i)}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.SendReliableMsg(0, []byte{byte(i)}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []*Conn{server, client} {
+			_, data, err := c.RecvMsg(ctx)
+			if err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+			if data[0] != byte(i) {
+				t.Fatalf("got message %d, want %d", data[0], i)
+			}
+		}
+	}
+	if addr := server.RemoteAddr().String(); addr != "rebound" {
+		t.Fatalf("server sends to %s, want rebound", addr)
+	}
+	if n := server.Stats().Migrations; n != 1 {
+		t.Fatalf("%d migrations, want 1", n)
+	}
+}
+
+// An attacker who sees the session id of a plaintext connection sends a
+// data packet of the session, and answers the path challenge if one comes.
+func TestMigrationPlaintext(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 1}}
+	network := NewMemNetwork(LinkConfig{}, 1)
+	_, server := newMemPair(t, network, pairConfig{}, channels, msgTypes)
+	attacker, err := network.Listen("attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	var packet bytes.Buffer
+	packet.WriteByte(dataPacket)
+	err = binary.Write(&packet, binary.LittleEndian,
+		packetHeader{server.LocalSessionId(), 1 << 16, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = attacker.WriteTo(packet.Bytes(), memAddr("server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenges := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, maxSealedPacketSize)
+		n, _, err := attacker.ReadFrom(b)
+		if err == nil {
+			challenges <- b[:n]
+		}
+	}()
+	select {
+	case challenge := <-challenges:
+		challenge[0] = pathResponsePacket
+		binary.LittleEndian.PutUint32(challenge[1:],
+			server.LocalSessionId())
+		attacker.WriteTo(challenge, memAddr("server"))
+		time.Sleep(50 * time.Millisecond)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if addr := server.RemoteAddr().String(); addr != "client" {
+		t.Fatalf("server sends to %s, want client", addr)
+	}
+	if n := server.Stats().Migrations; n != 0 {
+		t.Fatalf("%d migrations, want 0", n)
+	}
+}
@@ -0,0 +1,109 @@
+package rtgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// An entry is a message, or a fragment of a message, read from a packet.
+type entry struct {
+	msgType  uint16
+	msgID    uint32
+	data     []byte
+	fragment *fragmentHeader
+	periodic bool
+	baseSeq  uint32
+}
+
+var errUnknownMsgType = errors.New("unknown message type")
+
+// Reliable message ids are only accepted up to rMsgWindow ids ahead of the
+// oldest one not received yet, which bounds the state kept to suppress
+// duplicates. Senders do not send messages further than that ahead of the
+// oldest message not acked yet.
+const rMsgWindow = 1024
+
+// isNewRMsgID reports whether a reliable message id is within the window
+// of its channel and was not received yet.
+func (ch *channel) isNewRMsgID(id uint32) bool {
+	if id-ch.nextRMsgID >= rMsgWindow {
+		return false
+	}
+	_, found := ch.rMsgIDs[id]
+	return !found
+}
+
+// checkRMsgID only rejects ids ahead of the window, older ids are
+// duplicates that are ignored.
+func (ch *channel) checkRMsgID(id uint32) error {
+	if d := id - ch.nextRMsgID; d >= rMsgWindow && d < 1<<31 {
+		return fmt.Errorf("message id %d out of window", id)
+	}
+	return nil
+}
+
+// parseEntries reads all the messages of a packet. The packet is rejected
+// as a whole if one of them is malformed, before it is acked.
+func (c *Conn) parseEntries(data *bytes.Reader) ([]entry, error) {
+	entries := make([]entry, 0)
+	for data.Len() > 0 {
+		var e entry
+		err := binary.Read(data, binary.LittleEndian, &e.msgType)
+		if err != nil {
+			return nil, err
+		}
+		fragment := e.msgType&fragmentFlag != 0
+		e.periodic = e.msgType&periodicFlag != 0
+		e.msgType &^= fragmentFlag | periodicFlag
+		if int(e.msgType) >= len(c.msgTypes) {
+			return nil, errUnknownMsgType
+		}
+		t := c.msgTypes[e.msgType]
+		ch := c.typeChannels[e.msgType]
+		if e.periodic && (fragment || ch.reliable()) {
+			return nil, fmt.Errorf("invalid periodic message")
+		}
+
+		if fragment {
+			var header fragmentHeader
+			header, e.data, err = readFragment(data, t)
+			if err != nil {
+				return nil, err
+			}
+			e.fragment = &header
+			e.msgID = header.ID
+		} else {
+			if ch.delivery != Unreliable {
+				err = binary.Read(data, binary.LittleEndian, &e.msgID)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if e.periodic {
+				err = binary.Read(data, binary.LittleEndian, &e.baseSeq)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if e.baseSeq != 0 {
+				e.data, err = readDelta(data, t)
+			} else {
+				e.data, err = readMsgData(data, t)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ch.reliable() {
+			err = ch.checkRMsgID(e.msgID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
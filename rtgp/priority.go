@@ -0,0 +1,189 @@
+package rtgp
+
+import (
+	"sort"
+)
+
+// Every tick, messages are written by decreasing priority, the priority of
+// their type raised by one for every agingTicks ticks they have been
+// deferred because nothing of them fit, so that they are not starved.
+const agingTicks = 8
+
+type queuedMsg struct {
+	msg      msg
+	msgID    uint32
+	deferred int
+}
+
+// A candidate is a message that can be written in the packets of a tick.
+// For reliable messages, parts are the parts due and entries their data.
+// For periodic messages written in one entry, snapshot is kept as a
+// baseline once written.
+type candidate struct {
+	priority int
+	entries  [][]byte
+	parts    []*msgPart
+	deferred *int
+	queued   int
+	periodic *periodicMsg
+	snapshot []byte
+}
+
+// SetBandwidth limits the bytes sent per second on the connection, 0
+// meaning no limit. Messages that do not fit are deferred to the next
+// ticks, except periodic messages which are sent again on the next tick.
+func (c *Conn) SetBandwidth(bytesPerSec int) {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	c.mutex.Lock()
+	c.bandwidth = bytesPerSec
+	c.budget = float64(c.maxBudget())
+	c.budgetTime = c.now()
+	c.mutex.Unlock()
+}
+
+// The budget can be saved up over two ticks, or up to a packet more than a
+// tick brings, so that a full packet still fits on the ticks that also send
+// other messages.
+func (c *Conn) maxBudget() int {
+	tick := c.bandwidth / int(c.tickrate)
+	b := 2 * tick
+	if b < maxSealedPacketSize+tick {
+		b = maxSealedPacketSize + tick
+	}
+	return b
+}
+
+func (c *Conn) newPacketWriter() packetWriter {
+	w := packetWriter{c: c}
+	if c.bandwidth == 0 {
+		return w
+	}
+
+	now := c.now()
+	c.budget += float64(c.bandwidth) * now.Sub(c.budgetTime).Seconds()
+	c.budgetTime = now
+	if max := float64(c.maxBudget()); c.budget > max {
+		c.budget = max
+	}
+	w.limited = true
+	w.budget = int(c.budget)
+	return w
+}
+
+func (c *Conn) priority(msgType uint16, deferred int) int {
+	return c.msgTypes[msgType].Priority + deferred/agingTicks
+}
+
+func (c *Conn) candidates(snapshots [][]byte) []candidate {
+	candidates := make([]candidate, 0)
+
+	rto := c.rto()
+	now := c.now()
+	for _, ch := range c.channels {
+		ids := make([]uint32, 0, len(ch.reliableMsgs))
+		for id := range ch.reliableMsgs {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			if id-ids[0] >= rMsgWindow {
+				break
+			}
+			m := ch.reliableMsgs[id]
+			cand := candidate{priority: c.priority(m.msgType, m.deferred),
+				deferred: &m.deferred, queued: -1}
+			for _, part := range m.parts {
+				if part.due(now, rto) {
+					cand.entries = append(cand.entries, part.data)
+					cand.parts = append(cand.parts, part)
+				}
+			}
+			if len(cand.parts) > 0 {
+				candidates = append(candidates, cand)
+			}
+		}
+	}
+
+	for i := range c.msgs {
+		q := &c.msgs[i]
+		candidates = append(candidates, candidate{
+			priority: c.priority(q.msg.msgType, q.deferred),
+			entries:  c.encodeMsg(q.msg, q.msgID),
+			deferred: &q.deferred, queued: i})
+	}
+
+	for i, d := range snapshots {
+		p := &c.periodicMsgs[i]
+		if c.checkMsg(p.msgType, d) != nil {
+			c.stats.PeriodicDropped++
+			continue
+		}
+		cand := candidate{priority: c.priority(p.msgType, p.deferred),
+			deferred: &p.deferred, queued: -1}
+		msgID := c.seqID(p.msgType)
+		if entry := c.encodePeriodic(p, d, msgID); entry != nil {
+			cand.entries = [][]byte{entry}
+			cand.periodic = p
+			cand.snapshot = d
+		} else {
+			cand.entries = c.encodeMsg(msg{p.msgType, d}, msgID)
+		}
+		candidates = append(candidates, cand)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].priority > candidates[j].priority
+	})
+	return candidates
+}
+
+// writeMsgs writes what fits of the reliable messages due, the messages
+// queued and the snapshots of the periodic messages. Reliable messages can
+// be partly written, the parts left being sent on the next ticks. They are
+// only written in the first maxReliablePackets packets, so that the peer
+// can ack all the packets sent in one tick.
+func (c *Conn) writeMsgs(w *packetWriter, snapshots [][]byte) {
+	sent := make([]bool, len(c.msgs))
+	for _, cand := range c.candidates(snapshots) {
+		written := 0
+		if cand.parts != nil {
+			for i, part := range cand.parts {
+				if !w.fits(cand.entries[i:i+1], maxReliablePackets) {
+					break
+				}
+				w.write(part.data, part)
+				written++
+			}
+		} else if w.fits(cand.entries, 0) {
+			for _, entry := range cand.entries {
+				w.write(entry, nil)
+			}
+			written = len(cand.entries)
+		}
+
+		if written == 0 {
+			*cand.deferred++
+			continue
+		}
+		*cand.deferred = 0
+		if written < len(cand.entries) {
+			continue
+		}
+		if cand.queued >= 0 {
+			sent[cand.queued] = true
+		}
+		if cand.periodic != nil {
+			cand.periodic.recordSent(w.lSeq, cand.snapshot)
+		}
+	}
+
+	msgs := c.msgs[:0]
+	for i, q := range c.msgs {
+		if !sent[i] {
+			msgs = append(msgs, q)
+		}
+	}
+	c.msgs = msgs
+}
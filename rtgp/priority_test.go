@@ -0,0 +1,92 @@
+package rtgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// The high priority messages take most of the bandwidth, and are sent on
+// the tick after they are queued. The large message is sent with what is
+// left.
+func TestPriorityUnderBandwidth(t *testing.T) {
+	channels := []Channel{{"state", Unreliable}, {"bulk", ReliableUnordered}}
+	msgTypes := []MsgType{
+		{Size: 100, Priority: 10, Channel: "state"},
+		{Size: 10000, Variable: true, Channel: "bulk"},
+	}
+	const (
+		bandwidth = 20000
+		ticks     = 400
+		maxDelay  = 20 * time.Millisecond
+	)
+	clock := NewSimClock()
+	network := NewSimNetwork(LinkConfig{Latency: 5 * time.Millisecond}, 1,
+		clock)
+	client, server := newMemPair(t, network, pairConfig{}, channels,
+		msgTypes)
+	client.SetBandwidth(bandwidth)
+	start := clock.Now()
+	sentBefore := client.Stats().BytesSent
+
+	large := make([]byte, 10000)
+	_, err := rand.Read(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SendReliableMsg(1, large, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make([]time.Time, ticks)
+	recved := 0
+	var largeRecved bool
+	for i := 0; i < ticks; i++ {
+		data := make([]byte, 100)
+		binary.LittleEndian.PutUint32(data, uint32(i))
+		err = client.SendMsg(0, data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[i] = clock.Now()
+		clock.Advance(10 * time.Millisecond)
+
+		elapsed := clock.Now().Sub(start).Seconds()
+		budget := uint64(bandwidth*elapsed) + uint64(client.maxBudget())
+		if n := client.Stats().BytesSent - sentBefore; n > budget {
+			t.Fatalf("%d bytes sent in %.2fs, budget %d", n, elapsed,
+				budget)
+		}
+
+		for {
+			msgType, data, ok := server.TryRecvMsg()
+			if !ok {
+				break
+			}
+			if msgType == 1 {
+				if !bytes.Equal(data, large) {
+					t.Fatal("large message differs")
+				}
+				largeRecved = true
+				continue
+			}
+			id := binary.LittleEndian.Uint32(data)
+			if d := clock.Now().Sub(sent[id]); d > maxDelay {
+				t.Fatalf("message %d delayed %v", id, d)
+			}
+			recved++
+		}
+	}
+
+	// The last message is still on its way.
+	if recved != ticks-1 {
+		t.Fatalf("%d high priority messages received, want %d", recved,
+			ticks-1)
+	}
+	if !largeRecved {
+		t.Fatal("large message not received")
+	}
+}
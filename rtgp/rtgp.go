@@ -2,8 +2,11 @@ package rtgp
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -13,24 +16,41 @@ import (
 	"time"
 )
 
-var udpConnsLock chan map[int]*udpConnCount
-var connsLock chan map[string]*Conn
+var (
+	ErrClosed     = errors.New("connection closed")
+	ErrTimeout    = errors.New("connection timed out")
+	ErrPeerClosed = errors.New("connection closed by peer")
+	ErrOverflow   = errors.New("receive queue overflow")
+	ErrProtocol   = errors.New("protocol error")
+	ErrClosing    = errors.New("connection closing")
+	ErrExhausted  = errors.New("sequence numbers exhausted")
+)
 
-func init() {
-	udpConnsLock = make(chan map[int]*udpConnCount, 1)
-	udpConnsLock <- make(map[int]*udpConnCount)
-	connsLock = make(chan map[string]*Conn, 1)
-	connsLock <- make(map[string]*Conn)
-}
+// OverflowPolicy tells what is done with a received message when the
+// receive queue is full.
+type OverflowPolicy int
 
-type udpConnCount struct {
-	count   uint
-	udpConn *net.UDPConn
-}
+const (
+	// DropOldest drops the oldest message of the queue.
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the message received.
+	DropNewest
+	// CloseOnOverflow closes the connection with ErrOverflow.
+	CloseOnOverflow
+)
 
+const defaultRecvQueueSize = 1024
+
+// Size is the exact size of the messages of a type, or their maximum size
+// if Variable is set, at most the size of 1024 fragments. Channel is the
+// name of the channel they are sent on.
+// Messages of a higher Priority are sent first when they do not all fit in
+// the bandwidth of the connection.
 type MsgType struct {
 	Size     int
-	Reliable bool
+	Variable bool
+	Channel  string
+	Priority int
 }
 
 type msg struct {
@@ -38,34 +58,97 @@ type msg struct {
 	data    []byte
 }
 
+// A PeriodicSource gives the data of a periodic message. Snapshot is
+// called every time the message is written, from the goroutine sending the
+// packets of the connection, and returns the data appended to dst.
+type PeriodicSource interface {
+	Snapshot(dst []byte) []byte
+}
+
 type periodicMsg struct {
 	msgType  uint16
-	dataLock chan []byte
+	source   PeriodicSource
+	deferred int
+	sent     []baseline
+	nextSent int
 }
 
 type reliableMsg struct {
-	msg
-	seqs []uint32
+	msgType  uint16
+	parts    []*msgPart
+	deferred int
+}
+
+// A msgPart is a message, or one of its fragments, encoded as it is
+// written in packets.
+type msgPart struct {
+	data  []byte
+	seqs  []uint32
+	sent  time.Time
+	acked bool
 }
 
 type Conn struct {
 	mutex        sync.Mutex
 	msgTypes     []MsgType
-	udpConn      *net.UDPConn
-	udpRAddr     *net.UDPAddr
+	channels     []*channel
+	typeChannels []*channel
+	endpoint     *Endpoint
+	clock        *SimClock
+	rAddr        net.Addr
 	sending      bool
+	challenged   bool
+	challenge    uint32
+	established  chan struct{}
+	done         chan struct{}
+	err          error
+	released     bool
+	closing      bool
+	drained      chan struct{}
+	timeout      time.Duration
+	lastRecv     time.Time
+	lastSend     time.Time
+	ackPending   bool
+	unacked      int
 	tickrate     uint
+	minTickRate  uint
+	maxTickRate  uint
+	periodStart  time.Time
+	periodSent   int
+	periodLost   int
+	minRTT       time.Duration
+	bandwidth    int
+	budget       float64
+	budgetTime   time.Time
 	lSessionID   uint32
 	rSessionID   uint32
 	lSeq         uint32
 	rSeq         uint32
 	rSeqBits     uint32
-	nextMsgID    uint32
-	rMsgIDs      map[uint32]struct{}
+	session      *session
+	compression  bool
+	ephKey       *ecdh.PrivateKey
+	serverKey    *ecdh.PublicKey
+	rKey         []byte
+	acceptExtra  []byte
+	pathAddr     net.Addr
+	pathNonce    uint64
+	pathSent     time.Time
 	periodicMsgs []periodicMsg
-	reliableMsgs map[uint32]reliableMsg
+	rBaselines   map[uint16][]baseline
+	msgs         []queuedMsg
+	flush        chan struct{}
 	recved       chan struct{}
 	recvedMsgs   []msg
+	recvQueue    int
+	overflow     OverflowPolicy
+	handlers     []func(data []byte)
+	handled      chan struct{}
+	handledMsgs  []msg
+	dispatching  bool
+	stats        Stats
+	sentPackets  [sentHistory]sentPacket
+	lossSeq      uint32
 }
 
 func generateSessionID() (uint32, error) {
@@ -78,255 +161,1031 @@ func generateSessionID() (uint32, error) {
 	return uint32(id.Uint64()), nil
 }
 
-func NewConn(lAddr string, msgTypes []MsgType, tickrate uint) (*Conn, error) {
+func newConn(e *Endpoint, channels []Channel, msgTypes []MsgType,
+	tickrate uint) (*Conn, error) {
 	c := new(Conn)
+	c.endpoint = e
+	if e != nil {
+		c.clock = e.clock
+	}
 	c.msgTypes = msgTypes
 	c.sending = false
 	c.tickrate = tickrate
-	c.rMsgIDs = make(map[uint32]struct{})
 	c.periodicMsgs = make([]periodicMsg, 0)
-	c.reliableMsgs = make(map[uint32]reliableMsg)
-	c.recved = make(chan struct{})
+	c.rBaselines = make(map[uint16][]baseline)
+	c.msgs = make([]queuedMsg, 0)
+	c.flush = make(chan struct{}, 1)
+	c.established = make(chan struct{})
+	c.done = make(chan struct{})
+	c.drained = make(chan struct{}, 1)
+	c.timeout = defaultTimeout
+	c.recved = make(chan struct{}, 1)
 	c.recvedMsgs = make([]msg, 0)
+	c.recvQueue = defaultRecvQueueSize
+	c.overflow = DropOldest
+	c.handlers = make([]func(data []byte), len(msgTypes))
+	c.handled = make(chan struct{}, 1)
+	c.handledMsgs = make([]msg, 0)
 
 	var err error
-	c.lSessionID, err = generateSessionID()
+	c.channels, c.typeChannels, err = newChannels(channels, msgTypes)
 	if err != nil {
 		return nil, err
 	}
-
-	udpLAddr, err := net.ResolveUDPAddr("udp", lAddr)
+	c.lSessionID, err = generateSessionID()
 	if err != nil {
 		return nil, err
 	}
-	udpConns := <-udpConnsLock
-	_, found := udpConns[udpLAddr.Port]
-	if !found {
-		udpConn, err := net.ListenUDP("udp", udpLAddr)
-		if err != nil {
-			return nil, err
-		}
-		udpConns[udpLAddr.Port] = &udpConnCount{0, udpConn}
-		go recvUDP(udpConn)
-	}
-	udpConns[udpLAddr.Port].count++
-	c.udpConn = udpConns[udpLAddr.Port].udpConn
-	udpConnsLock <- udpConns
 
 	return c, nil
 }
 
+const (
+	defaultTimeout   = 10 * time.Second
+	keepalivePeriod  = time.Second
+	disconnectCopies = 3
+)
+
 func (c *Conn) Close() error {
 	c.mutex.Lock()
-	c.sending = false
-
-	conns := <-connsLock
-	delete(conns, c.udpRAddr.String())
-	connsLock <- conns
+	if c.released {
+		c.mutex.Unlock()
+		return fmt.Errorf("connection already closed")
+	}
+	c.released = true
 
-	udpConns := <-udpConnsLock
-	udpConnCount := udpConns[c.LocalPort()]
-	udpConnCount.count--
-	var err error
-	if udpConnCount.count == 0 {
-		err = udpConnCount.udpConn.Close()
-		delete(udpConns, c.LocalPort())
+	if c.sending {
+		// The disconnect packet is not acked, send a few copies of it
+		// so that the peer is likely to get one.
+		for i := 0; i < disconnectCopies; i++ {
+			c.sendDisconnect()
+		}
 	}
-	udpConnsLock <- udpConns
+	c.terminate(ErrClosed)
+	c.mutex.Unlock()
 
+	return nil
+}
+
+// CloseGracefully stops accepting messages to send and waits until all the
+// reliable messages sent are acked before closing the connection. If ctx is
+// done first, the connection is closed anyway and ctx.Err() returned.
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.released || c.closing {
+		c.mutex.Unlock()
+		return fmt.Errorf("connection already closed")
+	}
+	c.closing = true
+	sending := c.sending
 	c.mutex.Unlock()
-	return err
+	if !sending {
+		return c.Close()
+	}
+	c.Flush()
+
+	for {
+		c.mutex.Lock()
+		drained := c.pendingReliable() == 0
+		c.mutex.Unlock()
+		if drained {
+			break
+		}
+
+		if c.clock != nil {
+			c.clock.runUntil(func() bool {
+				return len(c.drained) > 0 || isClosed(c.done) ||
+					ctx.Err() != nil
+			}, 0)
+		}
+		select {
+		case <-c.drained:
+		case <-c.done:
+			c.Close()
+			return c.Err()
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+	return c.Close()
 }
 
 func (c *Conn) LocalPort() int {
-	return c.udpConn.LocalAddr().(*net.UDPAddr).Port
+	return c.endpoint.localPort()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.endpoint.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	rAddr := c.rAddr
+	c.mutex.Unlock()
+	return rAddr
 }
 
 func (c *Conn) LocalSessionId() uint32 {
 	return c.lSessionID
 }
 
-func (c *Conn) SetRemoteAddrAndSessionID(raddr string, id uint32) error {
+const (
+	connectRetryPeriod = 100 * time.Millisecond
+	connectTimeout     = 5 * time.Second
+)
+
+func (c *Conn) Connect(raddr string) error {
+	return c.connect(raddr, nil)
+}
+
+// ConnectSecure connects to a server listening with ListenSecure, serverKey
+// being the public key of the server.
+func (c *Conn) ConnectSecure(raddr string, serverKey *ecdh.PublicKey) error {
+	if serverKey == nil || serverKey.Curve() != ecdh.X25519() {
+		return fmt.Errorf("invalid server key")
+	}
+	return c.connect(raddr, serverKey)
+}
+
+func (c *Conn) connect(raddr string, serverKey *ecdh.PublicKey) error {
+	rAddr, err := c.endpoint.conn.ResolveAddr(raddr)
+	if err != nil {
+		return err
+	}
+	var ephKey *ecdh.PrivateKey
+	var ephPub []byte
+	if serverKey != nil {
+		ephKey, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		ephPub = ephKey.PublicKey().Bytes()
+	}
+
 	c.mutex.Lock()
-	if c.sending {
+	if c.released {
 		c.mutex.Unlock()
-		return fmt.Errorf("remote address and session id already set")
+		return ErrClosed
 	}
-
-	udpRAddr, err := net.ResolveUDPAddr("udp", raddr)
+	if c.rAddr != nil {
+		c.mutex.Unlock()
+		return fmt.Errorf("connection already established")
+	}
+	err = c.endpoint.addConn(rAddr, c)
 	if err != nil {
 		c.mutex.Unlock()
 		return err
 	}
-	c.udpRAddr = udpRAddr
-	c.rSessionID = id
-	conns := <-connsLock
-	conns[c.udpRAddr.String()] = c
-	connsLock <- conns
+	c.rAddr = rAddr
+	c.ephKey = ephKey
+	c.serverKey = serverKey
+	c.mutex.Unlock()
 
+	if c.clock != nil {
+		return c.simConnect(ephPub)
+	}
+	ticker := time.NewTicker(connectRetryPeriod)
+	defer ticker.Stop()
+	timeout := time.After(connectTimeout)
+	for {
+		c.sendConnect(ephPub)
+
+		select {
+		case <-c.established:
+			return nil
+		case <-c.done:
+			return c.Err()
+		case <-timeout:
+			c.mutex.Lock()
+			c.terminate(ErrTimeout)
+			c.mutex.Unlock()
+			return c.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Conn) sendConnect(ephPub []byte) {
+	c.mutex.Lock()
+	if c.challenged {
+		c.sendHandshake(challengeResponsePacket,
+			handshakePacket{c.lSessionID, 0, c.challenge,
+				c.handshakeFlags()}, ephPub)
+	} else {
+		c.sendHandshake(connectRequestPacket,
+			handshakePacket{c.lSessionID, 0, 0, 0}, nil)
+	}
+	c.mutex.Unlock()
+}
+
+func (c *Conn) establish() {
 	c.sending = true
-	go sendUDP(c)
+	c.lastRecv = c.now()
+	close(c.established)
+	if c.clock != nil {
+		c.clock.schedule(tickPeriod(c.tickrate), c.simTick)
+	} else {
+		go sendUDP(c)
+	}
+}
+
+func (c *Conn) terminate(err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	c.sending = false
+	close(c.done)
+
+	c.endpoint.removeConn(c.rAddr, c)
+}
 
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Conn) Err() error {
+	c.mutex.Lock()
+	err := c.err
+	c.mutex.Unlock()
+	return err
+}
+
+func (c *Conn) SetTimeout(timeout time.Duration) {
+	c.mutex.Lock()
+	c.timeout = timeout
 	c.mutex.Unlock()
-	return nil
 }
 
 func (c *Conn) SetTickRate(tickrate uint) {
 	c.mutex.Lock()
 	c.tickrate = tickrate
+	c.minTickRate = 0
+	c.maxTickRate = 0
+	c.mutex.Unlock()
+}
+
+// SetRecvQueue bounds the number of received messages waiting to be read.
+// Dropped messages are counted in Stats, even reliable ones.
+func (c *Conn) SetRecvQueue(size int, policy OverflowPolicy) {
+	if size < 1 {
+		size = 1
+	}
+	c.mutex.Lock()
+	c.recvQueue = size
+	c.overflow = policy
+	for len(c.recvedMsgs) > size {
+		c.recvedMsgs = c.recvedMsgs[1:]
+		c.stats.RecvDropped++
+	}
+	for len(c.handledMsgs) > size {
+		c.handledMsgs = c.handledMsgs[1:]
+		c.stats.RecvDropped++
+	}
 	c.mutex.Unlock()
 }
 
-func (c *Conn) SendPeriodicMsg(msgType uint16, dataLock chan []byte) {
+// Handle makes the messages of type msgType be passed to handler instead of
+// being queued for RecvMsg, including those already queued. Handlers are
+// called one at a time, in the order the messages are received, from a
+// goroutine of the connection. A nil handler queues the messages for
+// RecvMsg again.
+func (c *Conn) Handle(msgType uint16, handler func(data []byte)) error {
+	err := c.checkMsgType(msgType)
+	if err != nil {
+		return err
+	}
+
 	c.mutex.Lock()
-	c.periodicMsgs = append(c.periodicMsgs, periodicMsg{msgType, dataLock})
+	c.handlers[msgType] = handler
+	if handler != nil {
+		queued := c.recvedMsgs
+		c.recvedMsgs = make([]msg, 0, len(queued))
+		for _, m := range queued {
+			if m.msgType == msgType {
+				c.handledMsgs = append(c.handledMsgs, m)
+			} else {
+				c.recvedMsgs = append(c.recvedMsgs, m)
+			}
+		}
+		if len(c.handledMsgs) > 0 {
+			signal(c.handled)
+		}
+		if !c.dispatching {
+			c.dispatching = true
+			go dispatch(c)
+		}
+	}
 	c.mutex.Unlock()
+	return nil
+}
+
+func dispatch(c *Conn) {
+	for {
+		c.mutex.Lock()
+		if len(c.handledMsgs) == 0 {
+			c.mutex.Unlock()
+			select {
+			case <-c.handled:
+				continue
+			case <-c.done:
+			}
+			// Messages received before the connection was closed
+			// are still handled.
+			c.mutex.Lock()
+			if len(c.handledMsgs) == 0 {
+				c.mutex.Unlock()
+				return
+			}
+		}
+		m := c.handledMsgs[0]
+		c.handledMsgs = c.handledMsgs[1:]
+		handler := c.handlers[m.msgType]
+		if handler == nil && c.enqueue(&c.recvedMsgs, m) {
+			signal(c.recved)
+		}
+		c.mutex.Unlock()
+
+		if handler != nil {
+			handler(m.data)
+		}
+	}
 }
 
-func (c *Conn) SendMsg(msgType uint16, data []byte, now bool) {
+func (c *Conn) checkMsgType(msgType uint16) error {
+	if int(msgType) >= len(c.msgTypes) {
+		return fmt.Errorf("unknown message type %d", msgType)
+	}
+	return nil
+}
+
+func (c *Conn) checkMsg(msgType uint16, data []byte) error {
+	err := c.checkMsgType(msgType)
+	if err != nil {
+		return err
+	}
+
+	t := c.msgTypes[msgType]
+	if len(data) > maxMsgSize {
+		return fmt.Errorf("message of type %d too long: %d bytes, "+
+			"max %d", msgType, len(data), maxMsgSize)
+	}
+	if t.Variable {
+		if len(data) > t.Size {
+			return fmt.Errorf("message of type %d too long: %d bytes, "+
+				"max %d", msgType, len(data), t.Size)
+		}
+	} else if len(data) != t.Size {
+		return fmt.Errorf("message of type %d has wrong size: %d bytes, "+
+			"expected %d", msgType, len(data), t.Size)
+	}
+	return nil
+}
+
+// SendPeriodicMsg sends a message of type msgType every tick, its data
+// being taken from source. The data is checked each time it is written,
+// messages with an invalid size are left out of the packet and counted in
+// Stats. The peer keeps the baselines of delta encoding by message type, so
+// a type can only be sent periodically from one source.
+func (c *Conn) SendPeriodicMsg(msgType uint16, source PeriodicSource) error {
+	err := c.checkMsgType(msgType)
+	if err != nil {
+		return err
+	}
+	if c.typeChannels[msgType].reliable() {
+		return fmt.Errorf("message type %d is reliable", msgType)
+	}
+	if source == nil {
+		return fmt.Errorf("nil periodic source")
+	}
+
+	c.mutex.Lock()
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrClosing
+	}
+	for _, p := range c.periodicMsgs {
+		if p.msgType == msgType {
+			c.mutex.Unlock()
+			return fmt.Errorf("message type %d already sent periodically",
+				msgType)
+		}
+	}
+	c.periodicMsgs = append(c.periodicMsgs, periodicMsg{msgType, source, 0,
+		make([]baseline, deltaHistory), 0})
+	c.mutex.Unlock()
+	return nil
 }
 
-func (c *Conn) SendReliableMsg(msgType uint16, data []byte, now bool) {
-	seqs := make([]uint32, 0)
+func (c *Conn) SendMsg(msgType uint16, data []byte, now bool) error {
+	err := c.checkMsg(msgType, data)
+	if err != nil {
+		return err
+	}
+	if c.typeChannels[msgType].reliable() {
+		return fmt.Errorf("message type %d is reliable", msgType)
+	}
+
 	c.mutex.Lock()
-	c.reliableMsgs[c.nextMsgID] = reliableMsg{msg{msgType, data}, seqs}
-	c.nextMsgID++
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrClosing
+	}
+	c.msgs = append(c.msgs, queuedMsg{msg{msgType, data},
+		c.seqID(msgType), 0})
 	c.mutex.Unlock()
+	if now {
+		c.Flush()
+	}
+	return nil
 }
 
-func (c *Conn) RecvMsg() (msgType uint16, data []byte) {
-	<-c.recved
+func (c *Conn) SendReliableMsg(msgType uint16, data []byte, now bool) error {
+	err := c.checkMsg(msgType, data)
+	if err != nil {
+		return err
+	}
+	ch := c.typeChannels[msgType]
+	if !ch.reliable() {
+		return fmt.Errorf("message type %d is not reliable", msgType)
+	}
+
 	c.mutex.Lock()
-	msgType = c.recvedMsgs[len(c.recvedMsgs)-1].msgType
-	data = c.recvedMsgs[len(c.recvedMsgs)-1].data
-	c.recvedMsgs = c.recvedMsgs[:len(c.recvedMsgs)-1]
+	if c.closing {
+		c.mutex.Unlock()
+		return ErrClosing
+	}
+	entries := c.encodeMsg(msg{msgType, data}, ch.nextMsgID)
+	parts := make([]*msgPart, len(entries))
+	for i, entry := range entries {
+		parts[i] = &msgPart{data: entry, seqs: make([]uint32, 0)}
+	}
+	ch.reliableMsgs[ch.nextMsgID] = &reliableMsg{msgType, parts, 0}
+	ch.nextMsgID++
 	c.mutex.Unlock()
-	return
+	if now {
+		c.Flush()
+	}
+	return nil
+}
+
+func (c *Conn) Flush() {
+	select {
+	case c.flush <- struct{}{}:
+		if c.clock != nil {
+			c.clock.schedule(0, c.simFlush)
+		}
+	default:
+	}
 }
 
+// RecvMsg waits for a message until ctx is done or the connection is
+// closed. Messages received before the connection was closed can still be
+// read.
+func (c *Conn) RecvMsg(ctx context.Context) (msgType uint16, data []byte,
+	err error) {
+	for {
+		msgType, data, ok := c.TryRecvMsg()
+		if ok {
+			return msgType, data, nil
+		}
+
+		if c.clock != nil {
+			c.clock.runUntil(func() bool {
+				return len(c.recved) > 0 || isClosed(c.done) ||
+					ctx.Err() != nil
+			}, 0)
+		}
+		select {
+		case <-c.recved:
+		case <-c.done:
+			msgType, data, ok := c.TryRecvMsg()
+			if ok {
+				return msgType, data, nil
+			}
+			return 0, nil, c.Err()
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// TryRecvMsg returns the next received message if there is one, without
+// waiting.
+func (c *Conn) TryRecvMsg() (msgType uint16, data []byte, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.recvedMsgs) == 0 {
+		return 0, nil, false
+	}
+	m := c.recvedMsgs[0]
+	c.recvedMsgs = c.recvedMsgs[1:]
+	if len(c.recvedMsgs) > 0 {
+		signal(c.recved)
+	}
+	return m.msgType, m.data, true
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	dataPacket uint8 = iota
+	connectRequestPacket
+	challengePacket
+	challengeResponsePacket
+	connectAcceptPacket
+	disconnectPacket
+	pathChallengePacket
+	pathResponsePacket
+)
+
 type packetHeader struct {
 	SessionID uint32
 	LSeq      uint32
 	RSeq      uint32
 	RSeqBits  uint32
+	Flags     uint8
 }
 
-const maxPacketSize = 1400
+// The client asks for options in the Flags of its challenge response, the
+// server answers with those it agrees to in its accept packet.
+type handshakePacket struct {
+	ClientSessionID uint32
+	ServerSessionID uint32
+	Challenge       uint32
+	Flags           uint8
+}
+
+// Packets start with their kind and a packetHeader, what is left is used
+// to write messages.
+const (
+	maxPacketSize    = 1400
+	packetHeaderSize = 1 + 17
+	maxEntrySize     = maxPacketSize - packetHeaderSize
+)
+
+// Sequence numbers never wrap: they are the nonces of sealed packets, and
+// the peer would take the packets after a wrap for old ones. A connection
+// is closed with ErrExhausted once it has sent maxLSeq packets, the margin
+// left being more than a tick can send.
+const maxLSeq = math.MaxUint32 - 1<<16
 
+// Bit j of rSeqBits is set if packet rSeq-j was received. Packets that
+// are late but still within that window are accepted and acked, duplicates
+// and older packets are rejected.
 func (c *Conn) updateRSeqs(newRSeq uint32) bool {
-	if newRSeq < c.rSeq {
+	if newRSeq > c.rSeq {
+		d := newRSeq - c.rSeq
+		c.recordRecvWindowShift(d)
+		c.rSeqBits <<= d
+		c.rSeqBits |= 1
+		c.rSeq = newRSeq
+		return true
+	}
+
+	d := c.rSeq - newRSeq
+	if d >= 32 || c.rSeqBits&(1<<d) != 0 {
 		return false
 	}
-	d := newRSeq - c.rSeq
-	c.rSeqBits <<= d
-	c.rSeqBits |= 1
-	c.rSeq = newRSeq
+	c.rSeqBits |= 1 << d
 	return true
 }
 
 func acked(seqs []uint32, ackedSeq uint32, ackedSeqBits uint32) bool {
 	for _, seq := range seqs {
-		var j uint32
-		for j = 0; j < 32; j++ {
-			if seq == ackedSeq-j && ackedSeqBits|1<<j != 0 {
-				return true
-			}
+		j := ackedSeq - seq
+		if j < 32 && ackedSeqBits&(1<<j) != 0 {
+			return true
 		}
 	}
 	return false
 }
 
+const (
+	initialRTO = 200 * time.Millisecond
+	minRTO     = 20 * time.Millisecond
+	ackEvery   = 16
+
+	maxReliablePackets = 16
+)
+
+// rto is how long a reliable message is waited for an ack before it is
+// sent again.
+func (c *Conn) rto() time.Duration {
+	if c.stats.RTT == 0 {
+		return initialRTO
+	}
+	rto := c.stats.RTT + 4*c.stats.Jitter
+	if rto < minRTO {
+		rto = minRTO
+	}
+	return rto
+}
+
+func (p *msgPart) due(now time.Time, rto time.Duration) bool {
+	return !p.acked && (len(p.seqs) == 0 || now.Sub(p.sent) >= rto)
+}
+
 func (c *Conn) updateMsgsToSend(ackedSeq uint32, ackedSeqBits uint32) {
-	for id, msg := range c.reliableMsgs {
-		if acked(msg.seqs, ackedSeq, ackedSeqBits) {
-			delete(c.reliableMsgs, id)
+	for _, ch := range c.channels {
+		for id, msg := range ch.reliableMsgs {
+			done := true
+			for _, part := range msg.parts {
+				if !part.acked &&
+					acked(part.seqs, ackedSeq, ackedSeqBits) {
+					part.acked = true
+				}
+				done = done && part.acked
+			}
+			if done {
+				delete(ch.reliableMsgs, id)
+			}
 		}
 	}
+	if c.closing && c.pendingReliable() == 0 {
+		signal(c.drained)
+	}
 }
 
-func (c *Conn) updateRecvedMsgs(data *bytes.Reader) {
-	for {
-		var m msg
-		err := binary.Read(data, binary.LittleEndian, &m.msgType)
+func (c *Conn) updateRecvedMsgs(entries []entry) {
+	for _, e := range entries {
+		if e.fragment != nil {
+			m, complete := c.addFragment(e)
+			if complete {
+				c.recvMsg(m, e.msgID)
+			}
+			continue
+		}
+		c.recvMsg(msg{e.msgType, e.data}, e.msgID)
+	}
+}
+
+func (c *Conn) recvMsg(m msg, msgID uint32) {
+	ch := c.typeChannels[m.msgType]
+	switch ch.delivery {
+	case Unreliable:
+		c.deliver(m)
+		return
+	case Sequenced:
+		if !ch.isNewSeqID(m.msgType, msgID) {
+			c.stats.StaleDropped++
+			return
+		}
+		ch.lastSeqIDs[m.msgType] = msgID
+		c.deliver(m)
+		return
+	}
+
+	if !ch.isNewRMsgID(msgID) {
+		return
+	}
+	ch.rMsgIDs[msgID] = struct{}{}
+	if ch.delivery == ReliableOrdered {
+		ch.orderedMsgs[msgID] = m
+	} else {
+		c.deliver(m)
+	}
+	c.deliverOrderedMsgs(ch)
+}
+
+func readMsgData(data *bytes.Reader, msgType MsgType) ([]byte, error) {
+	size := msgType.Size
+	if msgType.Variable {
+		var length uint16
+		err := binary.Read(data, binary.LittleEndian, &length)
 		if err != nil {
-			break
+			return nil, err
+		}
+		if int(length) > msgType.Size {
+			return nil, fmt.Errorf("message too long")
 		}
+		size = int(length)
+	}
 
-		alreadyRecved := false
-		if c.msgTypes[m.msgType].Reliable {
-			var msgID uint32
-			err = binary.Read(data, binary.LittleEndian, &msgID)
-			if err != nil {
-				break
-			}
+	if data.Len() < size {
+		return nil, fmt.Errorf("truncated message")
+	}
+	d := make([]byte, size)
+	data.Read(d)
+	return d, nil
+}
 
-			if _, found := c.rMsgIDs[msgID]; found {
-				alreadyRecved = true
-			}
-			c.rMsgIDs[msgID] = struct{}{}
+func (c *Conn) writeMsg(data *bytes.Buffer, m msg, msgID uint32) {
+	err := binary.Write(data, binary.LittleEndian, m.msgType)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.typeChannels[m.msgType].delivery != Unreliable {
+		err = binary.Write(data, binary.LittleEndian, msgID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if c.msgTypes[m.msgType].Variable {
+		err := binary.Write(data, binary.LittleEndian, uint16(len(m.data)))
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
+	data.Write(m.data)
+}
 
-		m.data = make([]byte, c.msgTypes[m.msgType].Size)
-		n, err := data.Read(m.data)
-		if err != nil || n != c.msgTypes[m.msgType].Size {
-			break
+func (c *Conn) deliver(m msg) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	if c.handlers[m.msgType] != nil {
+		if c.enqueue(&c.handledMsgs, m) {
+			signal(c.handled)
 		}
+		return
+	}
+	if c.enqueue(&c.recvedMsgs, m) {
+		signal(c.recved)
+	}
+}
 
-		if !alreadyRecved {
-			c.recvedMsgs = append(c.recvedMsgs, m)
-			go func() {
-				c.recved <- struct{}{}
-			}()
+// enqueue applies the overflow policy if queue is full, and returns whether
+// m was added to it.
+func (c *Conn) enqueue(queue *[]msg, m msg) bool {
+	if len(*queue) >= c.recvQueue {
+		c.stats.RecvDropped++
+		switch c.overflow {
+		case DropOldest:
+			*queue = (*queue)[1:]
+		case DropNewest:
+			return false
+		case CloseOnOverflow:
+			c.protocolClose(ErrOverflow)
+			return false
 		}
 	}
+	*queue = append(*queue, m)
+	return true
 }
 
-func recvUDP(udpConn *net.UDPConn) {
-	packetData := make([]byte, maxPacketSize)
-	var header packetHeader
+// protocolClose closes the connection because of the peer, which is told
+// about it.
+func (c *Conn) protocolClose(err error) {
+	if c.sending {
+		for i := 0; i < disconnectCopies; i++ {
+			c.sendDisconnect()
+		}
+	}
+	c.terminate(err)
+}
 
+// Ordered messages are held back until every message of their channel with
+// a lower id has been received.
+func (c *Conn) deliverOrderedMsgs(ch *channel) {
 	for {
-		n, raddr, err := udpConn.ReadFromUDP(packetData)
-		if err != nil {
+		if _, found := ch.rMsgIDs[ch.nextRMsgID]; !found {
 			break
 		}
-		conns := <-connsLock
-		c, found := conns[raddr.String()]
-		connsLock <- conns
-		if !found {
-			continue
+		delete(ch.rMsgIDs, ch.nextRMsgID)
+		if m, found := ch.orderedMsgs[ch.nextRMsgID]; found {
+			delete(ch.orderedMsgs, ch.nextRMsgID)
+			c.deliver(m)
 		}
+		ch.nextRMsgID++
+	}
+}
+
+// handleDataPacket returns false if the packet was rejected, because it
+// is not for this session or is malformed.
+func (c *Conn) handleDataPacket(packet []byte) bool {
+	var header packetHeader
+	data := bytes.NewReader(packet[1:])
+	err := binary.Read(data, binary.LittleEndian, &header)
+	if err != nil {
+		return false
+	}
 
-		data := bytes.NewReader(packetData[:n])
-		err = binary.Read(data, binary.LittleEndian, &header)
+	c.mutex.Lock()
+	if !c.sending || header.SessionID != c.lSessionID {
+		c.mutex.Unlock()
+		return false
+	}
+	if c.session != nil {
+		packet, err = c.session.openPacket(packet, packetHeaderSize,
+			header.LSeq)
 		if err != nil {
-			continue
+			c.stats.PacketsRejected++
+			c.mutex.Unlock()
+			return false
 		}
+		data = bytes.NewReader(packet[packetHeaderSize:])
+	}
+	if header.Flags&^compressedFlag != 0 ||
+		header.Flags&compressedFlag != 0 && !c.compression {
+		c.stats.PacketsRejected++
+		c.mutex.Unlock()
+		return false
+	}
+	if header.Flags&compressedFlag != 0 {
+		payload, err := decompress(packet[packetHeaderSize:], maxEntrySize)
+		if err != nil {
+			c.stats.PacketsRejected++
+			c.mutex.Unlock()
+			return false
+		}
+		data = bytes.NewReader(payload)
+	}
+	// Acks for packets that were not sent yet.
+	if header.RSeq > c.lSeq {
+		c.stats.PacketsRejected++
+		c.mutex.Unlock()
+		return false
+	}
+	entries, err := c.parseEntries(data)
+	if err == errUnknownMsgType {
+		c.stats.PacketsRejected++
+		c.protocolClose(ErrProtocol)
+		c.mutex.Unlock()
+		return false
+	}
+	if err != nil {
+		c.stats.PacketsRejected++
+		c.mutex.Unlock()
+		return false
+	}
+	// Replayed packets do not count as the peer being alive.
+	if !c.updateRSeqs(header.LSeq) {
+		c.mutex.Unlock()
+		return true
+	}
+	c.lastRecv = c.now()
+	c.recordRecvedBytes(len(packet))
 
-		c.mutex.Lock()
-		if header.SessionID != c.lSessionID {
-			//continue
+	c.recordAcks(header.RSeq, header.RSeqBits)
+	c.updateMsgsToSend(header.RSeq, header.RSeqBits)
+
+	if len(entries) > 0 {
+		c.ackPending = true
+	}
+	// Only the last 32 packets can be acked, send an ack before the peer
+	// sends more than that during one of our ticks.
+	c.unacked++
+	if c.unacked >= ackEvery {
+		c.Flush()
+	}
+	c.updateRecvedMsgs(c.applyDeltas(entries, header.LSeq))
+	c.mutex.Unlock()
+	return true
+}
+
+// Disconnect packets hold the session id, and in secure mode a sequence
+// number to seal them with.
+const (
+	disconnectSize       = 1 + 4
+	sealedDisconnectSize = disconnectSize + 4
+)
+
+func (c *Conn) handleDisconnect(packet []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.sending {
+		return false
+	}
+
+	if c.session != nil {
+		if len(packet) != sealedDisconnectSize+sealOverhead {
+			return false
 		}
+		seq := binary.LittleEndian.Uint32(packet[disconnectSize:])
+		var err error
+		packet, err = c.session.openPacket(packet, sealedDisconnectSize,
+			seq)
+		if err != nil {
+			c.stats.PacketsRejected++
+			return false
+		}
+	} else if len(packet) != disconnectSize {
+		return false
+	}
 
-		if !c.updateRSeqs(header.LSeq) {
-			continue
+	if binary.LittleEndian.Uint32(packet[1:]) != c.lSessionID {
+		return false
+	}
+	c.terminate(ErrPeerClosed)
+	return true
+}
+
+func (c *Conn) sendDisconnect() {
+	var data bytes.Buffer
+	data.WriteByte(disconnectPacket)
+	err := binary.Write(&data, binary.LittleEndian, c.rSessionID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	packet := data.Bytes()
+	if c.session != nil {
+		c.lSeq++
+		err = binary.Write(&data, binary.LittleEndian, c.lSeq)
+		if err != nil {
+			log.Fatal(err)
 		}
+		packet = c.session.sealPacket(data.Bytes(), sealedDisconnectSize,
+			c.lSeq)
+	}
+	c.endpoint.conn.WriteTo(packet, c.rAddr)
+}
 
-		c.updateMsgsToSend(header.RSeq, header.RSeqBits)
+// handleHandshake returns false if the packet was rejected.
+func (c *Conn) handleHandshake(kind uint8, p handshakePacket,
+	extra []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
 
-		c.updateRecvedMsgs(data)
-		c.mutex.Unlock()
+	switch kind {
+	case challengePacket:
+		if c.sending || p.ClientSessionID != c.lSessionID ||
+			len(extra) != 0 {
+			return false
+		}
+		c.challenged = true
+		c.challenge = p.Challenge
+		var ephPub []byte
+		if c.ephKey != nil {
+			ephPub = c.ephKey.PublicKey().Bytes()
+		}
+		c.sendHandshake(challengeResponsePacket,
+			handshakePacket{c.lSessionID, 0, c.challenge,
+				c.handshakeFlags()}, ephPub)
+	case connectAcceptPacket:
+		if c.sending || p.ClientSessionID != c.lSessionID ||
+			p.Flags&^c.handshakeFlags() != 0 {
+			return false
+		}
+		if c.serverKey != nil {
+			s, err := clientHandshake(c.ephKey, c.serverKey, p, extra)
+			if err != nil {
+				return false
+			}
+			c.session = s
+		} else if len(extra) != 0 {
+			return false
+		}
+		c.rSessionID = p.ServerSessionID
+		c.compression = p.Flags&compressionFlag != 0
+		c.establish()
+	case challengeResponsePacket:
+		// The client did not get our accept packet, send it again.
+		if !c.sending || p.ClientSessionID != c.rSessionID ||
+			!bytes.Equal(extra, c.rKey) {
+			return false
+		}
+		c.sendHandshake(connectAcceptPacket,
+			handshakePacket{c.rSessionID, c.lSessionID, 0,
+				c.handshakeFlags()}, c.acceptExtra)
+	default:
+		return false
 	}
+	return true
+}
+
+func (c *Conn) sendHandshake(kind uint8, p handshakePacket, extra []byte) {
+	c.endpoint.sendHandshake(c.rAddr, kind, p, extra)
+}
+
+func tickPeriod(tickrate uint) time.Duration {
+	return time.Duration(1 / float64(tickrate) * float64(time.Second))
 }
 
 func newTicker(tickrate uint) *time.Ticker {
-	period := time.Duration(1 / float64(tickrate) * float64(time.Second))
-	return time.NewTicker(period)
+	return time.NewTicker(tickPeriod(tickrate))
 }
 
 func (c *Conn) writeHeader(data *bytes.Buffer) uint32 {
 	c.lSeq++
-	header := packetHeader{c.rSessionID, c.lSeq, c.rSeq, c.rSeqBits}
+	c.recordSentPacket(c.lSeq)
+	data.WriteByte(dataPacket)
+	header := packetHeader{c.rSessionID, c.lSeq, c.rSeq, c.rSeqBits, 0}
 	err := binary.Write(data, binary.LittleEndian, header)
 	if err != nil {
 		log.Fatal(err)
@@ -334,36 +1193,143 @@ func (c *Conn) writeHeader(data *bytes.Buffer) uint32 {
 	return c.lSeq
 }
 
-func (c *Conn) writePeriodicMsgs(data *bytes.Buffer) {
-	for _, msg := range c.periodicMsgs {
-		err := binary.Write(data, binary.LittleEndian, msg.msgType)
-		if err != nil {
-			log.Fatal(err)
+// A packetWriter spreads the messages written in it over as many packets
+// as needed. If the bandwidth is limited, it counts the bytes written
+// against the budget of the tick.
+type packetWriter struct {
+	c       *Conn
+	data    bytes.Buffer
+	lSeq    uint32
+	packets [][]byte
+	limited bool
+	budget  int
+	spent   int
+}
+
+func (w *packetWriter) packetOverhead() int {
+	if w.c.session != nil {
+		return packetHeaderSize + sealOverhead
+	}
+	return packetHeaderSize
+}
+
+func (w *packetWriter) write(entry []byte, part *msgPart) {
+	if w.data.Len() > 0 && w.data.Len()+len(entry) > maxPacketSize {
+		w.finish()
+	}
+	if w.data.Len() == 0 {
+		w.lSeq = w.c.writeHeader(&w.data)
+		w.spent += w.packetOverhead()
+	}
+	w.data.Write(entry)
+	w.spent += len(entry)
+	if part != nil {
+		if len(part.seqs) > 0 {
+			w.c.stats.Retransmissions++
+		}
+		part.seqs = append(part.seqs, w.lSeq)
+		part.sent = w.c.now()
+	}
+}
+
+// fits reports whether entries can be written without going over the
+// budget, and without the last of them being in packet maxPackets or
+// after if maxPackets is not 0. A whole budget can always be spent on
+// entries bigger than it, so that they are sent eventually.
+func (w *packetWriter) fits(entries [][]byte, maxPackets int) bool {
+	n := len(w.packets)
+	size := w.data.Len()
+	cost := 0
+	for _, entry := range entries {
+		if size > 0 && size+len(entry) > maxPacketSize {
+			n++
+			size = 0
 		}
-		size := c.msgTypes[msg.msgType].Size
-		d := <-msg.dataLock
-		data.Write(d[:size])
-		msg.dataLock <- d
+		if size == 0 {
+			size = packetHeaderSize
+			cost += w.packetOverhead()
+		}
+		size += len(entry)
+		cost += len(entry)
 	}
+	if maxPackets > 0 && n >= maxPackets {
+		return false
+	}
+	return !w.limited || w.spent+cost <= w.budget ||
+		w.spent == 0 && w.budget >= w.c.maxBudget()
 }
 
-func (c *Conn) writeReliableMsgs(data *bytes.Buffer, lSeq uint32) {
-	for id, msg := range c.reliableMsgs {
-		msg.seqs = append(msg.seqs, lSeq)
+func (w *packetWriter) finish() {
+	if w.data.Len() == 0 {
+		return
+	}
+	packet := make([]byte, w.data.Len())
+	copy(packet, w.data.Bytes())
+	if w.c.compression {
+		compressed := compress(packet[:packetHeaderSize:packetHeaderSize],
+			packet[packetHeaderSize:])
+		if len(compressed) < len(packet) {
+			packet = compressed
+			packet[packetHeaderSize-1] |= compressedFlag
+		}
+	}
+	if w.c.session != nil {
+		packet = w.c.session.sealPacket(packet, packetHeaderSize, w.lSeq)
+	}
+	w.packets = append(w.packets, packet)
+	w.data.Reset()
+}
 
-		err := binary.Write(data, binary.LittleEndian, msg.msgType)
-		if err != nil {
-			log.Fatal(err)
+func (c *Conn) reliableMsgsDue() bool {
+	rto := c.rto()
+	now := c.now()
+	for _, ch := range c.channels {
+		var oldest uint32
+		first := true
+		for id := range ch.reliableMsgs {
+			if first || id < oldest {
+				oldest = id
+				first = false
+			}
 		}
 
-		err = binary.Write(data, binary.LittleEndian, id)
-		if err != nil {
-			log.Fatal(err)
+		for id, msg := range ch.reliableMsgs {
+			if id-oldest >= rMsgWindow {
+				continue
+			}
+			for _, part := range msg.parts {
+				if part.due(now, rto) {
+					return true
+				}
+			}
 		}
+	}
+	return false
+}
+
+func (c *Conn) hasDataToSend() bool {
+	return len(c.msgs) > 0 || len(c.periodicMsgs) > 0 || c.ackPending ||
+		c.now().Sub(c.lastSend) >= keepalivePeriod || c.reliableMsgsDue()
+}
+
+// takeSnapshots returns the data of the periodic messages, appended to
+// bufs. Sources are called without holding the lock of the connection, so
+// that a slow source only delays the packets of its connection.
+func (c *Conn) takeSnapshots(bufs [][]byte) [][]byte {
+	c.mutex.Lock()
+	sources := make([]PeriodicSource, len(c.periodicMsgs))
+	for i, p := range c.periodicMsgs {
+		sources[i] = p.source
+	}
+	c.mutex.Unlock()
 
-		size := c.msgTypes[msg.msgType].Size
-		data.Write(msg.data[:size])
+	for len(bufs) < len(sources) {
+		bufs = append(bufs, nil)
 	}
+	for i, source := range sources {
+		bufs[i] = source.Snapshot(bufs[i][:0])
+	}
+	return bufs[:len(sources)]
 }
 
 func sendUDP(c *Conn) {
@@ -371,31 +1337,87 @@ func sendUDP(c *Conn) {
 	tickrate := c.tickrate
 	c.mutex.Unlock()
 	ticker := newTicker(tickrate)
+	defer ticker.Stop()
+	var snapshots [][]byte
 	for {
-		<-ticker.C
-
-		c.mutex.Lock()
-		if !c.sending {
-			break
+		select {
+		case <-ticker.C:
+		case <-c.flush:
+		case <-c.done:
+			return
 		}
 
+		var sending bool
+		snapshots, sending = c.sendTick(snapshots)
+		if !sending {
+			return
+		}
+		c.mutex.Lock()
 		if tickrate != c.tickrate {
 			tickrate = c.tickrate
-			ticker.Stop()
-			ticker = newTicker(tickrate)
+			ticker.Reset(tickPeriod(tickrate))
 		}
+		c.mutex.Unlock()
+	}
+}
 
-		var data bytes.Buffer
+// sendTick sends the packets of a tick, and returns false once the
+// connection stopped sending.
+func (c *Conn) sendTick(snapshots [][]byte) ([][]byte, bool) {
+	snapshots = c.takeSnapshots(snapshots)
+	c.mutex.Lock()
+	if !c.sending {
+		c.mutex.Unlock()
+		return snapshots, false
+	}
 
-		lSeq := c.writeHeader(&data)
-		c.writeReliableMsgs(&data, lSeq)
-		c.writePeriodicMsgs(&data)
-		//fmt.Printf("%d %d %b\n", c.lSeq, c.rSeq, c.rSeqBits)
-		//fmt.Println(data.Bytes())
+	if c.now().Sub(c.lastRecv) > c.timeout {
+		c.terminate(ErrTimeout)
 		c.mutex.Unlock()
+		return snapshots, false
+	}
+	if c.lSeq >= maxLSeq {
+		for i := 0; i < disconnectCopies; i++ {
+			c.sendDisconnect()
+		}
+		c.terminate(ErrExhausted)
+		c.mutex.Unlock()
+		return snapshots, false
+	}
 
-		_, err := c.udpConn.WriteToUDP(data.Bytes(), c.udpRAddr)
-		if err != nil {
+	c.adaptTickRate()
+	if !c.hasDataToSend() {
+		c.mutex.Unlock()
+		return snapshots, true
+	}
+
+	// Send an empty packet if nothing fits but an ack or a keepalive is
+	// due.
+	w := c.newPacketWriter()
+	c.writeMsgs(&w, snapshots)
+	if len(w.packets) == 0 && w.data.Len() == 0 {
+		if !c.ackPending && c.now().Sub(c.lastSend) < keepalivePeriod {
+			c.mutex.Unlock()
+			return snapshots, true
 		}
+		w.lSeq = c.writeHeader(&w.data)
+		w.spent += w.packetOverhead()
+	}
+	w.finish()
+	c.ackPending = false
+	c.unacked = 0
+	c.lastSend = c.now()
+	if w.limited {
+		c.budget -= float64(w.spent)
+	}
+	for _, packet := range w.packets {
+		c.recordSentBytes(len(packet))
+	}
+	rAddr := c.rAddr
+	c.mutex.Unlock()
+
+	for _, packet := range w.packets {
+		c.endpoint.conn.WriteTo(packet, rAddr)
 	}
+	return snapshots, true
 }
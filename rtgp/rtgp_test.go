@@ -0,0 +1,437 @@
+package rtgp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var lossyLink = LinkConfig{
+	Latency:      5 * time.Millisecond,
+	Jitter:       5 * time.Millisecond,
+	Loss:         0.2,
+	Duplicate:    0.1,
+	Reorder:      0.1,
+	ReorderDelay: 20 * time.Millisecond,
+}
+
+type pairConfig struct {
+	secure   bool
+	compress bool
+}
+
+// newMemPair connects a client to a server over n. Both endpoints are
+// closed when the test ends.
+func newMemPair(t *testing.T, n *MemNetwork, cfg pairConfig,
+	channels []Channel, msgTypes []MsgType) (client, server *Conn) {
+	t.Helper()
+	spc, err := n.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	se, err := NewEndpoint(spc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { se.Close() })
+	cpc, err := n.Listen("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := NewEndpoint(cpc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ce.Close() })
+
+	var key *ecdh.PrivateKey
+	var l *Listener
+	if cfg.secure {
+		key, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err = se.ListenSecure(channels, msgTypes, 100, key)
+	} else {
+		l, err = se.Listen(channels, msgTypes, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetCompression(cfg.compress)
+
+	client, err = ce.NewConn(channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetCompression(cfg.compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.secure {
+		err = client.ConnectSecure("server", key.PublicKey())
+	} else {
+		err = client.Connect("server")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+var pairConfigs = []struct {
+	name string
+	cfg  pairConfig
+}{
+	{"plain", pairConfig{}},
+	{"secure", pairConfig{secure: true}},
+	{"compressed", pairConfig{compress: true}},
+	{"secure compressed", pairConfig{secure: true, compress: true}},
+}
+
+func TestReliableOrderedOverLossyLink(t *testing.T) {
+	channels := []Channel{{"ordered", ReliableOrdered}}
+	msgTypes := []MsgType{{Size: 4, Channel: "ordered"}}
+	const n = 200
+
+	for _, pc := range pairConfigs {
+		t.Run(pc.name, func(t *testing.T) {
+			network := NewMemNetwork(lossyLink, 1)
+			client, server := newMemPair(t, network, pc.cfg, channels,
+				msgTypes)
+			for i := 0; i < n; i++ {
+				data := make([]byte, 4)
+				binary.LittleEndian.PutUint32(data, uint32(i))
+				err := client.SendReliableMsg(0, data, i%10 == 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(),
+				20*time.Second)
+			defer cancel()
+			for i := 0; i < n; i++ {
+				_, data, err := server.RecvMsg(ctx)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if id := binary.LittleEndian.Uint32(data); id != uint32(i) {
+					t.Fatalf("got message %d, want %d", id, i)
+				}
+			}
+			if _, _, ok := server.TryRecvMsg(); ok {
+				t.Fatal("duplicate message delivered")
+			}
+		})
+	}
+}
+
+func TestFragmentedReliableOverLossyLink(t *testing.T) {
+	channels := []Channel{{"lobby", ReliableUnordered}}
+	msgTypes := []MsgType{{Size: 20000, Variable: true, Channel: "lobby"}}
+
+	for _, pc := range pairConfigs {
+		t.Run(pc.name, func(t *testing.T) {
+			network := NewMemNetwork(lossyLink, 1)
+			client, server := newMemPair(t, network, pc.cfg, channels,
+				msgTypes)
+			data := make([]byte, 20000)
+			_, err := rand.Read(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.SendReliableMsg(0, data, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(),
+				20*time.Second)
+			defer cancel()
+			_, got, err := server.RecvMsg(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("reassembled message differs")
+			}
+		})
+	}
+}
+
+func TestAcked(t *testing.T) {
+	tests := []struct {
+		seqs         []uint32
+		ackedSeq     uint32
+		ackedSeqBits uint32
+		want         bool
+	}{
+		{nil, 10, 0xffffffff, false},
+		{[]uint32{10}, 10, 1, true},
+		{[]uint32{10}, 10, 0, false},
+		{[]uint32{8}, 10, 1 << 2, true},
+		{[]uint32{8}, 10, 1<<1 | 1, false},
+		{[]uint32{5, 9}, 10, 1 << 1, true},
+		{[]uint32{5, 9}, 10, 1 << 5, true},
+		{[]uint32{10}, 41, 0xffffffff, true},
+		{[]uint32{9}, 41, 0xffffffff, false},
+		{[]uint32{11}, 10, 0xffffffff, false},
+	}
+	for _, tt := range tests {
+		got := acked(tt.seqs, tt.ackedSeq, tt.ackedSeqBits)
+		if got != tt.want {
+			t.Errorf("acked(%v, %d, %#x) = %v, want %v", tt.seqs,
+				tt.ackedSeq, tt.ackedSeqBits, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateRSeqs(t *testing.T) {
+	c := new(Conn)
+	steps := []struct {
+		seq  uint32
+		want bool
+	}{
+		{1, true},
+		{1, false},
+		{4, true},
+		{2, true},  // late, inside the window
+		{3, true},  // late, inside the window
+		{2, false}, // duplicate of a late packet
+		{4, false},
+		{40, true},
+		{9, true},  // 31 packets late, still inside the window
+		{8, false}, // 32 packets late, outside the window
+		{9, false},
+		{41, true},
+	}
+	for i, s := range steps {
+		if got := c.updateRSeqs(s.seq); got != s.want {
+			t.Fatalf("step %d: updateRSeqs(%d) = %v, want %v", i, s.seq,
+				got, s.want)
+		}
+	}
+	if c.rSeq != 41 {
+		t.Fatalf("rSeq = %d, want 41", c.rSeq)
+	}
+	// 9 left the window when 41 was received.
+	if want := uint32(1<<0 | 1<<1); c.rSeqBits != want {
+		t.Fatalf("rSeqBits = %#x, want %#x", c.rSeqBits, want)
+	}
+}
+
+func TestReplayedDataPacket(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 4}}
+	sender, err := newConn(nil, channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recver, err := newConn(nil, channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.rSessionID = recver.lSessionID
+	recver.sending = true
+
+	err = sender.SendMsg(0, []byte{1, 2, 3, 4}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sender.newPacketWriter()
+	sender.writeMsgs(&w, nil)
+	w.finish()
+	packet := w.packets[0]
+
+	if !recver.handleDataPacket(append([]byte(nil), packet...)) {
+		t.Fatal("packet rejected")
+	}
+	lastRecv := recver.lastRecv
+	stats := recver.stats
+	time.Sleep(time.Millisecond)
+	recver.handleDataPacket(append([]byte(nil), packet...))
+	if !recver.lastRecv.Equal(lastRecv) {
+		t.Error("replayed packet refreshed the last receive time")
+	}
+	if recver.stats.PacketsRecved != stats.PacketsRecved ||
+		recver.stats.BytesRecved != stats.BytesRecved {
+		t.Error("replayed packet counted as received")
+	}
+	if len(recver.recvedMsgs) != 1 {
+		t.Errorf("%d messages delivered, want 1", len(recver.recvedMsgs))
+	}
+}
+
+type fixedSource []byte
+
+func (s fixedSource) Snapshot(dst []byte) []byte {
+	return append(dst, s...)
+}
+
+func TestPeriodicDropped(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 4}, {Size: 2, Variable: true}}
+	c, err := newConn(nil, channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := []fixedSource{{1, 2, 3, 4}, {1, 2, 3}}
+	for i, source := range sources {
+		err = c.SendPeriodicMsg(uint16(i), source)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for tick := 1; tick <= 3; tick++ {
+		w := c.newPacketWriter()
+		c.writeMsgs(&w, c.takeSnapshots(nil))
+		if n := c.Stats().PeriodicDropped; n != uint64(tick) {
+			t.Fatalf("tick %d: %d periodic messages dropped, want %d",
+				tick, n, tick)
+		}
+	}
+}
+
+func TestPeriodicTypeRegisteredOnce(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 4}, {Size: 4}}
+	c, err := newConn(nil, channels, msgTypes, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendPeriodicMsg(0, fixedSource{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendPeriodicMsg(0, fixedSource{5, 6, 7, 8})
+	if err == nil {
+		t.Fatal("message type registered twice")
+	}
+	err = c.SendPeriodicMsg(1, fixedSource{5, 6, 7, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeqExhausted(t *testing.T) {
+	channels := []Channel{{"", Unreliable}}
+	msgTypes := []MsgType{{Size: 4}}
+	for _, pc := range pairConfigs[:2] {
+		t.Run(pc.name, func(t *testing.T) {
+			clock := NewSimClock()
+			network := NewSimNetwork(LinkConfig{Latency: time.Millisecond},
+				1, clock)
+			client, server := newMemPair(t, network, pc.cfg, channels,
+				msgTypes)
+			client.mutex.Lock()
+			client.lSeq = maxLSeq - 20
+			client.mutex.Unlock()
+
+			recved := 0
+			for i := 0; i < 100; i++ {
+				data := make([]byte, 4)
+				binary.LittleEndian.PutUint32(data, uint32(i))
+				client.SendMsg(0, data, true)
+				clock.Advance(10 * time.Millisecond)
+				for {
+					if _, _, ok := server.TryRecvMsg(); !ok {
+						break
+					}
+					recved++
+				}
+			}
+
+			if client.Err() != ErrExhausted {
+				t.Fatalf("client error %v, want %v", client.Err(),
+					ErrExhausted)
+			}
+			if server.Err() != ErrPeerClosed {
+				t.Fatalf("server error %v, want %v", server.Err(),
+					ErrPeerClosed)
+			}
+			if recved < 10 {
+				t.Fatalf("%d messages received before the limit", recved)
+			}
+			lSeq := client.lSeq
+			if lSeq < maxLSeq || lSeq > maxLSeq+disconnectCopies {
+				t.Fatalf("last sequence number %d, limit %d", lSeq,
+					uint32(maxLSeq))
+			}
+		})
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	channels := []Channel{{"ordered", ReliableOrdered}}
+	msgTypes := []MsgType{{Size: 4, Channel: "ordered"}}
+	const n = 100
+
+	for _, pc := range pairConfigs {
+		t.Run(pc.name, func(t *testing.T) {
+			clock := NewSimClock()
+			network := NewSimNetwork(lossyLink, 1, clock)
+			client, server := newMemPair(t, network, pc.cfg, channels,
+				msgTypes)
+			for i := 0; i < n; i++ {
+				data := make([]byte, 4)
+				binary.LittleEndian.PutUint32(data, uint32(i))
+				err := client.SendReliableMsg(0, data, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := client.CloseGracefully(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < n; i++ {
+				_, data, err := server.RecvMsg(context.Background())
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if id := binary.LittleEndian.Uint32(data); id != uint32(i) {
+					t.Fatalf("got message %d, want %d", id, i)
+				}
+			}
+			_, _, err = server.RecvMsg(context.Background())
+			if err != ErrPeerClosed {
+				t.Fatalf("got %v after the messages, want %v", err,
+					ErrPeerClosed)
+			}
+		})
+	}
+}
+
+func TestCloseGracefullyUnreachable(t *testing.T) {
+	channels := []Channel{{"", ReliableUnordered}}
+	msgTypes := []MsgType{{Size: 4}}
+	network := NewMemNetwork(LinkConfig{}, 1)
+	client, _ := newMemPair(t, network, pairConfig{}, channels, msgTypes)
+	network.SetLinkConfig(LinkConfig{Loss: 1})
+	err := client.SendReliableMsg(0, []byte{1, 2, 3, 4}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	err = client.CloseGracefully(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if client.Err() != ErrClosed {
+		t.Fatalf("connection error %v, want %v", client.Err(), ErrClosed)
+	}
+}
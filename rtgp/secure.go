@@ -0,0 +1,163 @@
+package rtgp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+// In secure mode the client sends an ephemeral X25519 key in its challenge
+// response, the server answers with an ephemeral key of its own and a tag
+// proving that it owns the static key the client was given. The session
+// keys are derived from both key agreements, one AES-GCM key for each
+// direction. Packets are then sealed with the sequence number they carry
+// as nonce, the headers being authenticated but left in clear.
+const (
+	keySize      = 32
+	sealOverhead = 16
+
+	maxSealedPacketSize = maxPacketSize + sealOverhead
+)
+
+type session struct {
+	seal cipher.AEAD
+	open cipher.AEAD
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return aead
+}
+
+func newSession(ee, es []byte, p handshakePacket, clientKey,
+	serverKey []byte, client bool) (*session, error) {
+	secret := make([]byte, 0, len(ee)+len(es))
+	secret = append(secret, ee...)
+	secret = append(secret, es...)
+
+	var salt bytes.Buffer
+	err := binary.Write(&salt, binary.LittleEndian, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	salt.Write(clientKey)
+	salt.Write(serverKey)
+
+	keys, err := hkdf.Key(sha256.New, secret, salt.Bytes(),
+		"rtgp session keys", 2*keySize)
+	if err != nil {
+		return nil, err
+	}
+	s := new(session)
+	s.seal = newAEAD(keys[:keySize])
+	s.open = newAEAD(keys[keySize:])
+	if !client {
+		s.seal, s.open = s.open, s.seal
+	}
+	return s, nil
+}
+
+func nonce(seq uint32) []byte {
+	n := make([]byte, 12)
+	binary.LittleEndian.PutUint32(n, seq)
+	return n
+}
+
+// sealPacket encrypts what follows the first headerSize bytes of packet.
+func (s *session) sealPacket(packet []byte, headerSize int,
+	seq uint32) []byte {
+	sealed := make([]byte, headerSize, len(packet)+sealOverhead)
+	copy(sealed, packet[:headerSize])
+	return s.seal.Seal(sealed, nonce(seq), packet[headerSize:],
+		packet[:headerSize])
+}
+
+func (s *session) openPacket(packet []byte, headerSize int,
+	seq uint32) ([]byte, error) {
+	if len(packet) < headerSize+sealOverhead {
+		return nil, fmt.Errorf("truncated packet")
+	}
+	opened := make([]byte, headerSize, len(packet)-sealOverhead)
+	copy(opened, packet[:headerSize])
+	return s.open.Open(opened, nonce(seq), packet[headerSize:],
+		packet[:headerSize])
+}
+
+// serverHandshake returns the session of a client that sent clientKey in
+// its challenge response, and what to append to the accept packet p.
+func serverHandshake(key *ecdh.PrivateKey, p handshakePacket,
+	clientKey []byte) (*session, []byte, error) {
+	rKey, err := ecdh.X25519().NewPublicKey(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ee, err := ephKey.ECDH(rKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	es, err := key.ECDH(rKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephPub := ephKey.PublicKey().Bytes()
+	s, err := newSession(ee, es, p, clientKey, ephPub, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tag := s.seal.Seal(nil, nonce(0), nil,
+		encodeHandshake(connectAcceptPacket, p, ephPub))
+	return s, append(ephPub, tag...), nil
+}
+
+// clientHandshake checks the accept packet p of the server and returns the
+// session.
+func clientHandshake(ephKey *ecdh.PrivateKey, serverKey *ecdh.PublicKey,
+	p handshakePacket, extra []byte) (*session, error) {
+	if len(extra) != keySize+sealOverhead {
+		return nil, fmt.Errorf("invalid accept packet")
+	}
+	ephPub := extra[:keySize]
+	rKey, err := ecdh.X25519().NewPublicKey(ephPub)
+	if err != nil {
+		return nil, err
+	}
+	ee, err := ephKey.ECDH(rKey)
+	if err != nil {
+		return nil, err
+	}
+	es, err := ephKey.ECDH(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSession(ee, es, p, ephKey.PublicKey().Bytes(), ephPub,
+		true)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.open.Open(nil, nonce(0), extra[keySize:],
+		encodeHandshake(connectAcceptPacket, p, ephPub))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
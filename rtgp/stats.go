@@ -0,0 +1,155 @@
+package rtgp
+
+import (
+	"time"
+)
+
+// RTT and Jitter are smoothed as in TCP, Jitter being the mean deviation of
+// the round-trip time. The loss rates are moving averages over the packets
+// that have left the 32 packets acknowledgement window. RecvDropped counts
+// the messages dropped because the receive queue was full, PacketsRejected
+// the packets of the session that were malformed. TickRate is the current
+// tick rate, which varies if it is adaptive. Migrations counts the times
+// the peer was found at a new address, StaleDropped the sequenced messages
+// dropped because a newer one was delivered, PeriodicDropped the snapshots
+// of periodic messages left out of packets because of their size.
+type Stats struct {
+	RTT             time.Duration
+	Jitter          time.Duration
+	SentLoss        float64
+	RecvLoss        float64
+	BytesSent       uint64
+	BytesRecved     uint64
+	PacketsSent     uint64
+	PacketsRecved   uint64
+	Retransmissions uint64
+	RecvDropped     uint64
+	PacketsRejected uint64
+	TickRate        uint
+	Migrations      uint64
+	StaleDropped    uint64
+	PeriodicDropped uint64
+	PendingReliable int
+}
+
+const (
+	sentHistory  = 256
+	lossWeight   = 1.0 / 32
+	maxLossBurst = 256
+)
+
+type sentPacket struct {
+	seq    uint32
+	time   time.Time
+	acked  bool
+	judged bool
+}
+
+func (c *Conn) Stats() Stats {
+	c.mutex.Lock()
+	stats := c.stats
+	stats.PendingReliable = c.pendingReliable()
+	stats.TickRate = c.tickrate
+	c.mutex.Unlock()
+	return stats
+}
+
+func (c *Conn) recordSentPacket(seq uint32) {
+	p := &c.sentPackets[seq%sentHistory]
+	c.judge(p, !p.acked)
+	*p = sentPacket{seq: seq, time: c.now()}
+}
+
+func (c *Conn) recordSentBytes(n int) {
+	c.stats.PacketsSent++
+	c.stats.BytesSent += uint64(n)
+}
+
+func (c *Conn) recordRecvedBytes(n int) {
+	c.stats.PacketsRecved++
+	c.stats.BytesRecved += uint64(n)
+}
+
+func updateLoss(loss float64, lost bool) float64 {
+	sample := 0.0
+	if lost {
+		sample = 1.0
+	}
+	return loss + lossWeight*(sample-loss)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.minRTT == 0 || sample < c.minRTT {
+		c.minRTT = sample
+	}
+	if c.stats.RTT == 0 {
+		c.stats.RTT = sample
+		c.stats.Jitter = sample / 2
+		return
+	}
+	d := c.stats.RTT - sample
+	if d < 0 {
+		d = -d
+	}
+	c.stats.Jitter += (d - c.stats.Jitter) / 4
+	c.stats.RTT += (sample - c.stats.RTT) / 8
+}
+
+// recordAcks is called with the acknowledgement window of every packet
+// received. Packets older than the window are counted as lost if they were
+// never acked. For the congestion period, packets are judged as soon as they
+// are acked or judged lost.
+func (c *Conn) recordAcks(ackedSeq uint32, ackedSeqBits uint32) {
+	var j uint32
+	for j = 0; j < 32; j++ {
+		if ackedSeqBits&(1<<j) == 0 {
+			continue
+		}
+		p := &c.sentPackets[(ackedSeq-j)%sentHistory]
+		if p.seq != ackedSeq-j || p.acked {
+			continue
+		}
+		p.acked = true
+		c.judge(p, false)
+		if j == 0 {
+			c.updateRTT(c.now().Sub(p.time))
+		}
+	}
+	for j = lossReorder; j < 32; j++ {
+		p := &c.sentPackets[(ackedSeq-j)%sentHistory]
+		if ackedSeqBits&(1<<j) == 0 && p.seq == ackedSeq-j && !p.acked {
+			c.judge(p, true)
+		}
+	}
+
+	if ackedSeq >= 32 && c.lossSeq < ackedSeq-31 &&
+		ackedSeq-31-c.lossSeq > maxLossBurst {
+		c.lossSeq = ackedSeq - 31 - maxLossBurst
+	}
+	for ackedSeq >= 32 && c.lossSeq < ackedSeq-31 {
+		if c.lossSeq > 0 {
+			p := c.sentPackets[c.lossSeq%sentHistory]
+			if p.seq == c.lossSeq {
+				c.stats.SentLoss = updateLoss(c.stats.SentLoss, !p.acked)
+			}
+		}
+		c.lossSeq++
+	}
+}
+
+// recordRecvWindowShift is called before the receive window is moved d
+// packets forward, the packets leaving it were either received or lost.
+func (c *Conn) recordRecvWindowShift(d uint32) {
+	var k uint32
+	for k = 0; k < d && k < 32; k++ {
+		j := 31 - k
+		if j >= c.rSeq {
+			continue
+		}
+		lost := c.rSeqBits&(1<<j) == 0
+		c.stats.RecvLoss = updateLoss(c.stats.RecvLoss, lost)
+	}
+	for ; k < d && k < 32+maxLossBurst; k++ {
+		c.stats.RecvLoss = updateLoss(c.stats.RecvLoss, true)
+	}
+}
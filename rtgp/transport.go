@@ -0,0 +1,87 @@
+package rtgp
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// PacketConn is the datagram transport used by connections. ResolveAddr
+// turns an address string into an address that WriteTo accepts.
+type PacketConn interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	ResolveAddr(addr string) (net.Addr, error)
+	Close() error
+}
+
+// A simPacketConn is not read when it has a SimClock, its packets are
+// handed to the handler from the events of the clock.
+type simPacketConn interface {
+	simClock() *SimClock
+	setHandler(handler func(packet []byte, from net.Addr))
+}
+
+// Addresses are resolved with the network of the socket, so that a name
+// resolves to an address of the family the socket can send to.
+type udpPacketConn struct {
+	*net.UDPConn
+	network string
+}
+
+// ListenUDP listens on an IPv4 or an IPv6 address only if lAddr holds one,
+// so that "0.0.0.0:3000" and "[::]:3000" can be listened on side by side.
+// Without an IP, as in ":3000", it listens on both when the host can.
+func ListenUDP(lAddr string) (PacketConn, error) {
+	network := "udp"
+	host, _, err := net.SplitHostPort(lAddr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			network = "udp4"
+		} else {
+			network = "udp6"
+		}
+	}
+
+	udpLAddr, err := net.ResolveUDPAddr(network, lAddr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP(network, udpLAddr)
+	if err != nil {
+		return nil, err
+	}
+	return udpPacketConn{udpConn, network}, nil
+}
+
+func (c udpPacketConn) ResolveAddr(addr string) (net.Addr, error) {
+	return net.ResolveUDPAddr(c.network, addr)
+}
+
+// addrKey identifies the peer at addr. For UDP, IPv4 addresses are the same
+// whether they are mapped to IPv6 or not, as they are on dual-stack
+// sockets, and zones are interface names.
+func addrKey(addr net.Addr) string {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr.String()
+	}
+	ip, ok := netip.AddrFromSlice(udpAddr.IP)
+	if !ok {
+		return addr.String()
+	}
+	ip = ip.Unmap()
+	if zone := udpAddr.Zone; zone != "" && ip.Is6() {
+		if index, err := strconv.Atoi(zone); err == nil {
+			if ifi, err := net.InterfaceByIndex(index); err == nil {
+				zone = ifi.Name
+			}
+		}
+		ip = ip.WithZone(zone)
+	}
+	return netip.AddrPortFrom(ip, uint16(udpAddr.Port)).String()
+}
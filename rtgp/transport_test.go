@@ -0,0 +1,65 @@
+package rtgp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestAddrKey(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+	linkLocal := net.ParseIP("fe80::1")
+	type test struct {
+		name string
+		addr net.Addr
+		want string
+	}
+	tests := []test{
+		{"ipv4", &net.UDPAddr{IP: v4.To4(), Port: 3000}, "192.0.2.1:3000"},
+		{"mapped ipv4", &net.UDPAddr{IP: v4.To16(), Port: 3000},
+			"192.0.2.1:3000"},
+		{"mapped ipv4 with zone", &net.UDPAddr{IP: v4, Port: 3000,
+			Zone: "eth0"}, "192.0.2.1:3000"},
+		{"ipv6", &net.UDPAddr{IP: v6, Port: 3000}, "[2001:db8::1]:3000"},
+		{"named zone", &net.UDPAddr{IP: linkLocal, Port: 3000,
+			Zone: "eth0"}, "[fe80::1%eth0]:3000"},
+		{"unknown numeric zone", &net.UDPAddr{IP: linkLocal, Port: 3000,
+			Zone: "999999"}, "[fe80::1%999999]:3000"},
+		{"not udp", memAddr("peer"), "peer"},
+	}
+	if ifis, err := net.Interfaces(); err == nil && len(ifis) > 0 {
+		ifi := ifis[0]
+		tests = append(tests, test{"numeric zone",
+			&net.UDPAddr{IP: linkLocal, Port: 3000,
+				Zone: strconv.Itoa(ifi.Index)},
+			"[fe80::1%" + ifi.Name + "]:3000"})
+	}
+
+	for _, tt := range tests {
+		if got := addrKey(tt.addr); got != tt.want {
+			t.Errorf("%s: addrKey(%v) = %s, want %s", tt.name, tt.addr,
+				got, tt.want)
+		}
+	}
+}
+
+func TestUDPResolveAddr(t *testing.T) {
+	pc, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	addr, err := pc.ResolveAddr("localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.(*net.UDPAddr).IP.To4() == nil {
+		t.Errorf("IPv4 socket resolved localhost to %v", addr)
+	}
+	_, err = pc.ResolveAddr("[::1]:3000")
+	if err == nil {
+		t.Error("IPv4 socket resolved an IPv6 address")
+	}
+}